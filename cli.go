@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/maxking/weeclient/src/color"
+	"github.com/maxking/weeclient/src/weechat"
+)
+
+// Time allowed to connect and to get each reply for the commands that
+// don't keep running.
+const requestTimeout = time.Minute
+
+// Connect to the relay for the commands other than tui.
+func dial(ctx context.Context, cfg *config) (*weechat.Client, error) {
+	opts, err := cfg.options()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	c, err := weechat.Dial(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", opts.Address, err)
+	}
+	return c, nil
+}
+
+// Remove the weechat colors, for the output of the commands.
+func plain(s string) string {
+	return color.ReplaceWeechatColors(s, func(string) string { return "" })
+}
+
+func runSend(cfg *config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing the buffer")
+	}
+	buffer := args[0]
+	c, err := dial(context.Background(), cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	// The relay silently drops the input for a buffer that doesn't exist.
+	if !strings.HasPrefix(buffer, "0x") {
+		buffers, err := c.Buffers(ctx)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, buf := range buffers {
+			found = found || buf.FullName == buffer
+		}
+		if !found {
+			return fmt.Errorf("no buffer %v, see weeclient buffers", buffer)
+		}
+	}
+
+	if len(args) > 1 {
+		err = c.Send(buffer, strings.Join(args[1:], " "))
+	} else {
+		scanner := bufio.NewScanner(os.Stdin)
+		for err == nil && scanner.Scan() {
+			if text := scanner.Text(); text != "" {
+				err = c.Send(buffer, text)
+			}
+		}
+		if err == nil {
+			err = scanner.Err()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	// The relay doesn't answer the input, the ping makes sure it got all
+	// of it before quitting.
+	return c.Ping(ctx)
+}
+
+func runBuffers(cfg *config, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %v", args)
+	}
+	c, err := dial(context.Background(), cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	buffers, err := c.Buffers(ctx)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(buffers, func(i, j int) bool {
+		return buffers[i].Number < buffers[j].Number
+	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, buf := range buffers {
+		fmt.Fprintf(w, "%v\t%v\t%v\n", buf.Number, buf.FullName, plain(buf.Title))
+	}
+	return w.Flush()
+}
+
+// Print the lines with tabs between the date, the buffer, the prefix and
+// the message, reconnecting whenever the connection is lost.
+func runTail(cfg *config, args []string) error {
+	opts, err := cfg.options()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	r := weechat.NewReconnector(opts)
+	r.Lines = cfg.lines
+	disconnected := false
+	r.OnState = func(event weechat.ConnEvent) {
+		switch {
+		case event.State == weechat.ConnDisconnected:
+			disconnected = true
+		case event.State == weechat.ConnConnected && disconnected:
+			disconnected = false
+		default:
+			return
+		}
+		fmt.Fprintf(os.Stderr, "weeclient tail: %v\n", event)
+	}
+	if err := r.Connect(ctx); err != nil {
+		return fmt.Errorf("%v: %w", opts.Address, err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+
+	selected := func(buf *weechat.BufferState) bool {
+		for _, name := range args {
+			if buf.FullName == name || buf.ShortName == name {
+				return true
+			}
+		}
+		return len(args) == 0
+	}
+	// The State dedupes the lines fetched again after a reconnection and
+	// shares the lines between snapshots, so the last line printed in
+	// each buffer tells which ones are new. After an /upgrade all the
+	// lines are fetched again, they were printed already and only mark
+	// the last.
+	state := weechat.NewState(cfg.lines)
+	last := make(map[string]*weechat.WeechatLine)
+	upgraded := false
+	for msg := range r.Events() {
+		if err := state.Update(msg); err != nil {
+			fmt.Fprintf(os.Stderr, "weeclient tail: %v\n", err)
+			continue
+		}
+		if msg.Msgid == "_upgrade_ended" {
+			last = make(map[string]*weechat.WeechatLine)
+			upgraded = true
+		}
+		if msg.Msgid != "listlines" && msg.Msgid != "_buffer_line_added" {
+			continue
+		}
+		skip := upgraded && msg.Msgid == "listlines"
+		if skip {
+			upgraded = false
+		}
+		for _, buf := range state.Buffers() {
+			if !selected(buf) || len(buf.Lines) == 0 {
+				continue
+			}
+			lines := buf.Lines
+			for i := len(lines) - 1; i >= 0; i-- {
+				if lines[i] == last[buf.Pointer] {
+					lines = lines[i+1:]
+					break
+				}
+			}
+			for _, line := range lines {
+				if line.Displayed && !skip {
+					fmt.Printf("%v\t%v\t%v\t%v\n", line.Date.Format("2006-01-02 15:04:05"),
+						buf.FullName, plain(line.Prefix), plain(line.Message))
+				}
+			}
+			last[buf.Pointer] = buf.Lines[len(buf.Lines)-1]
+		}
+	}
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/maxking/weeclient/src/weechat"
+	"golang.org/x/term"
+)
+
+// Settings shared by all the commands, from the flags and the profile.
+type config struct {
+	relay        string
+	passwordFile string
+	passwordCmd  string
+	insecure     bool
+	lines        int
+	profile      string
+}
+
+// Create the flag set of a command with the flags of the config. The
+// usage is the arguments of the command after the flags.
+func newFlagSet(name string, usage string, description string) (*flag.FlagSet, *config) {
+	cfg := &config{}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&cfg.relay, "relay", "",
+		"`URI` of the relay, like weechats://host:9001 or wss://host/weechat, host:port is a websocket with SSL")
+	fs.StringVar(&cfg.passwordFile, "password-file", "", "read the password of the relay from the first line of the `file`")
+	fs.StringVar(&cfg.passwordCmd, "password-cmd", "", "run the `command` with sh and use its output as the password")
+	fs.BoolVar(&cfg.insecure, "insecure", false, "don't verify the certificate of the relay")
+	fs.IntVar(&cfg.lines, "lines", weechat.DefaultLines, "number of lines fetched for each buffer")
+	fs.StringVar(&cfg.profile, "profile", "", "use the settings of the profile `name` in "+profilesPath())
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: weeclient %v [flags] %v\n\n%v\n\nflags:\n", name, usage, description)
+		fs.PrintDefaults()
+	}
+	return fs, cfg
+}
+
+// Parse the arguments of the command and fill in the flags that aren't
+// given from the profile.
+func (c *config) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if c.profile != "" {
+		set := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		profile, err := loadProfile(c.profile)
+		if err != nil {
+			return err
+		}
+		for name, value := range profile {
+			if name == "profile" || fs.Lookup(name) == nil {
+				return fmt.Errorf("unknown setting %q in the profile %v", name, c.profile)
+			}
+			if set[name] {
+				continue
+			}
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("invalid %v in the profile %v: %w", name, c.profile, err)
+			}
+		}
+	}
+	if c.relay == "" {
+		return errors.New("no relay, use --relay or a --profile")
+	}
+	if c.passwordFile != "" && c.passwordCmd != "" {
+		return errors.New("only one of --password-file and --password-cmd can be used")
+	}
+	if c.lines < 1 {
+		return errors.New("--lines must be at least 1")
+	}
+	return nil
+}
+
+// Options to Dial the relay, with the password. The relay in the
+// returned options is the address, without the credentials a URI can
+// have.
+func (c *config) options() (weechat.Options, error) {
+	relay := c.relay
+	if !strings.Contains(relay, ":/") && !strings.HasPrefix(relay, "unix:") {
+		relay = "wss://" + relay
+	}
+	opts, err := weechat.ParseURI(relay)
+	if err != nil {
+		return opts, err
+	}
+	opts.Conn.TLS.KnownHosts = knownHosts()
+	if c.insecure {
+		opts.Conn.TLS.Insecure = true
+	}
+
+	password, err := c.password(opts.Address)
+	if err != nil {
+		return opts, err
+	}
+	// Authenticate with the password hashed using the strongest algorithm
+	// the relay supports. If the relay asks for a TOTP, it is generated
+	// from the secret in WEECLIENT_TOTP_SECRET if set, otherwise we ask
+	// for it.
+	opts.Auth = weechat.AuthOptions{
+		Password:   password,
+		TotpSecret: os.Getenv("WEECLIENT_TOTP_SECRET"),
+		TotpPrompt: func() (string, error) {
+			if !term.IsTerminal(int(os.Stdin.Fd())) {
+				return "", errors.New("the relay asks for a TOTP, set WEECLIENT_TOTP_SECRET")
+			}
+			fmt.Fprintf(os.Stderr, "TOTP for %v: ", opts.Address)
+			totp, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			return strings.TrimSpace(totp), err
+		},
+	}
+	return opts, nil
+}
+
+// Get the password from the file, the command or else ask for it without
+// echoing it.
+func (c *config) password(address string) (string, error) {
+	switch {
+	case c.passwordFile != "":
+		data, err := os.ReadFile(c.passwordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the password: %w", err)
+		}
+		return firstLine(string(data)), nil
+	case c.passwordCmd != "":
+		cmd := exec.Command("sh", "-c", c.passwordCmd)
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to run the password command: %w", err)
+		}
+		return firstLine(string(out)), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("no password, use --password-file or --password-cmd when not in a terminal")
+	}
+	fmt.Fprintf(os.Stderr, "Password for %v: ", address)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the password: %w", err)
+	}
+	return string(password), nil
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSuffix(s, "\r")
+}
+
+// Path of the profiles. Each profile starts with its [name] and has the
+// flags without the dashes, one per line:
+//
+//	[home]
+//	relay = weechats://example.org:9001
+//	password-cmd = pass show weechat
+//	lines = 50
+func profilesPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "weeclient", "profiles")
+}
+
+// Read the settings of the profile.
+func loadProfile(name string) (map[string]string, error) {
+	path := profilesPath()
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the profiles: %w", err)
+	}
+	defer file.Close()
+
+	var settings map[string]string
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if section == name && settings == nil {
+				settings = make(map[string]string)
+			}
+		case section == name:
+			i := strings.IndexByte(line, '=')
+			if i < 0 {
+				return nil, fmt.Errorf("%v:%v: expected name = value", path, n)
+			}
+			settings[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the profiles: %w", err)
+	}
+	if settings == nil {
+		return nil, fmt.Errorf("no profile %q in %v", name, path)
+	}
+	return settings, nil
+}
+
+// Certificates of the relays that aren't signed by a trusted CA, most
+// of them self signed, pinned once the user trusts them.
+func knownHosts() *weechat.KnownHosts {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return &weechat.KnownHosts{
+		Path:  filepath.Join(dir, "weeclient", "known_hosts"),
+		OnNew: askTrust,
+	}
+}
+
+// Ask whether to trust the certificate of a relay seen for the first
+// time, it is refused when not in a terminal.
+func askTrust(address string, fingerprint string) error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return refuseNewHost(address, fingerprint)
+	}
+	fmt.Fprintf(os.Stderr, "The certificate of %v isn't signed by a trusted CA, its SHA-256 fingerprint is\n%v\n"+
+		"Trust it? [y/N] ", address, fingerprint)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read the answer: %w", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("the certificate of %v isn't trusted", address)
+}
+
+// Refuse the certificate of a relay seen for the first time, when there
+// is nobody to ask.
+func refuseNewHost(address string, fingerprint string) error {
+	return fmt.Errorf("the certificate of %v with the SHA-256 fingerprint %v isn't signed by a trusted CA, "+
+		"run weeclient in a terminal to trust it", address, fingerprint)
+}
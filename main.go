@@ -1,22 +1,16 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"strings"
 
 	"github.com/maxking/weeclient/src/client"
 	"github.com/maxking/weeclient/src/weechat"
-)
-
-// Set of initial commands sent to weechat.
-const (
-	authCommand    = `init password=%v`
-	initialCommand = `(listbuffers) hdata buffer:gui_buffers(*) number,full_name,short_name,type,nicklist,title,local_variables,
-(listlines) hdata buffer:gui_buffers(*)/own_lines/last_line(-15)/data date,displayed,prefix,message,buffer
-sync
-`
+	"github.com/maxking/weeclient/src/weechat/commands"
 )
 
 // This requires setting up a relay that is listening at the localhost port 8080.
@@ -24,83 +18,129 @@ sync
 // the same thing by port forwarding.
 // sample command::
 // ssh -L 8080:localhost:8080 <remote-server>
+// weeclient tui --relay ws://localhost:8080/weechat
 
-func main() {
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Printf("Relay \n> ")
-	relay, _ := reader.ReadString('\n')
-	relay = strings.TrimSuffix(relay, "\n")
+// A subcommand of weeclient.
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(cfg *config, args []string) error
+}
+
+var subcommands = []command{
+	{"tui", "", "Start the terminal ui, the default command.", runTui},
+	{"send", "BUFFER [TEXT...]",
+		"Send text to a buffer.\n" +
+			"The buffer is given by its full name like irc.libera.#weechat, and without\n" +
+			"text every line of the standard input is sent.", runSend},
+	{"tail", "[BUFFER...]",
+		"Print the lines of the buffers as they come.\n" +
+			"It starts with the last --lines lines of each buffer, of all the buffers if\n" +
+			"none is given, and runs until interrupted.", runTail},
+	{"buffers", "", "List the buffers of the relay.", runBuffers},
+}
 
-	conn := weechat.WeechatConnFactory(weechat.WebsocketConnection, relay, "/weechat", true)
-	if err := conn.Connect(); err != nil {
-		fmt.Printf("Failed to connect to remote relay at %v: %v\n", relay, err)
-		os.Exit(1)
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: weeclient [command] [flags] [arguments]\n\ncommands:\n")
+	for _, cmd := range subcommands {
+		fmt.Fprintf(os.Stderr, "  %-8v %v\n", cmd.name, strings.SplitN(cmd.description, "\n", 2)[0])
 	}
+	fmt.Fprintf(os.Stderr, "\nRun weeclient <command> -h for the flags of a command.\n")
+}
 
-	fmt.Printf("Enter password for %v\n> ", relay)
-	text, _ := reader.ReadString('\n')
-	// TODO: handle error.
+func main() {
+	name, args := "tui", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage()
+		return
+	}
+	for _, cmd := range subcommands {
+		if cmd.name != name {
+			continue
+		}
+		fs, cfg := newFlagSet(cmd.name, cmd.usage, cmd.description)
+		err := cfg.parse(fs, args)
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		if err == nil {
+			err = cmd.run(cfg, fs.Args())
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "weeclient %v: %v\n", cmd.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "weeclient: unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
 
-	err := conn.Write([]byte(fmt.Sprintf(authCommand, text)))
+func runTui(cfg *config, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %v", args)
+	}
+	opts, err := cfg.options()
 	if err != nil {
-		fmt.Println("Failed to send auth message")
-		os.Exit(1)
+		return err
+	}
+	r := weechat.NewReconnector(opts)
+	r.Lines = cfg.lines
+	// Changes of the connection state shown in the terminal ui.
+	states := make(chan weechat.ConnEvent, 10)
+	r.OnState = func(event weechat.ConnEvent) {
+		states <- event
 	}
 
-	err = conn.Write([]byte(initialCommand))
-	if err != nil {
-		fmt.Println("Failed to send auth message")
-		os.Exit(1)
+	// The first connection is made before starting the terminal ui, so
+	// that a wrong password is reported right away. The replies to the
+	// initial commands come with the events, with their own ids, and are
+	// handled by the terminal ui.
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := r.Connect(ctx); err != nil {
+		cancel()
+		return fmt.Errorf("%v: %w", opts.Address, err)
+	}
+	// We can't prompt for a TOTP once the terminal ui runs, reconnecting
+	// then only works with WEECLIENT_TOTP_SECRET. Nor can we ask whether
+	// to trust a new certificate.
+	r.Options.Auth.TotpPrompt = nil
+	if known := r.Options.Conn.TLS.KnownHosts; known != nil {
+		known.OnNew = refuseNewHost
 	}
-	weeproto := weechat.Protocol{}
 
-	// Channel to process incoming message and passing it on to terminal ui.
-	// Goroutine runs in a loop and listens to messages from weechat relay.
-	weechan := make(chan *weechat.WeechatMessage)
-	// handle receiving of message.
+	// Keep reconnecting in the background whenever the connection is
+	// lost, until the terminal ui quits.
+	stopped := make(chan struct{})
 	go func() {
-		for {
-			// first, read the length of the next message and block on
-			// msgLen := make([]byte, 4)
-			// _, err = conn.Read(msgLen)
-			// if err != nil {
-			// 	fmt.Printf("Failed to read message length. %v", err)
-			// }
-			// length := int(binary.BigEndian.Uint32(msgLen)) - 4
-			// // now, read the complete message (msglen - 4 bytes for the length.)
-			// msg := make([]byte, length)
-			// _, err = conn.Read(msg)
-			// if err != nil {
-			// 	fmt.Printf("Failed to read message of lenth %v, err: %v", msgLen, err)
-			// }
-			msg, err := conn.Read()
-			if err != nil {
-				fmt.Printf("Failed to read message over websocket:%v\n", err)
-			}
-			weeMsg, err := weeproto.Decode(msg)
-			if err != nil {
-				weechan <- &weechat.WeechatMessage{
-					Msgid:  "error",
-					Object: weechat.WeechatObject{ObjType: "error", Value: err},
-				}
-			} else {
-				weechan <- weeMsg
-			}
-		}
+		r.Run(ctx)
+		close(states)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
 	}()
 
 	// channel to send message. message is received from terminal ui and sent to remote
 	// server in the goroutine.
-	sendchan := make(chan string)
+	sendchan := make(chan commands.Command)
 	// handle sending of message.
 	go func() {
-		for sendmsg := range sendchan {
-			if err = conn.Write([]byte(sendmsg)); err != nil {
+		for cmd := range sendchan {
+			if err := r.Command(cmd); err != nil {
 				// do something if failed to send message.
 			}
 		}
 	}()
 
-	// Start the terminal app.
-	client.TviewStart(weechan, sendchan)
+	// Start the terminal app with the incoming messages of all the
+	// connections.
+	client.TviewStart(r.Events(), sendchan, states)
+	return nil
 }
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/maxking/weeclient/src/color"
@@ -15,6 +16,15 @@ type Buffer struct {
 	Users    *tview.List
 	Input    *tview.InputField
 	NickList *tview.List
+	// Page with all the widgets of the buffer.
+	Layout *tview.Grid
+	// Hidden buffers aren't in the buffer list.
+	Hidden bool
+}
+
+// Name of the page of a buffer.
+func pageName(fullName string) string {
+	return fmt.Sprintf("page-%v", fullName)
 }
 
 type BufferListWidget struct {
@@ -61,3 +71,45 @@ func (w *BufferListWidget) AddBuffer(buffer string) {
 	}
 	w.List.InsertItem(index, buffer, "", 0, nil)
 }
+
+// Index of the buffer with the full name in the list, ignoring the unread
+// color, -1 if it isn't in the list.
+func (w *BufferListWidget) indexOf(fullName string) int {
+	for _, index := range w.List.FindItems(fullName, "", false, false) {
+		main, _ := w.List.GetItemText(index)
+		if color.RemoveColor(main) == fullName {
+			return index
+		}
+	}
+	return -1
+}
+
+// Remove a buffer from the buffer list widget.
+func (w *BufferListWidget) RemoveBuffer(fullName string) {
+	if index := w.indexOf(fullName); index >= 0 {
+		w.List.RemoveItem(index)
+	}
+}
+
+// Change the name of a buffer in the buffer list widget.
+func (w *BufferListWidget) RenameBuffer(oldName string, newName string) {
+	if index := w.indexOf(oldName); index >= 0 {
+		w.List.SetItemText(index, newName, "")
+	}
+}
+
+// Move a buffer in the buffer list widget before the first buffer with a
+// larger number, after its number changed. Buffers that aren't in the
+// list, like hidden ones, are added.
+func (w *BufferListWidget) MoveBuffer(buf *Buffer) {
+	w.RemoveBuffer(buf.FullName)
+	index := -1
+	for i := 0; i < w.List.GetItemCount(); i++ {
+		main, _ := w.List.GetItemText(i)
+		if other := w.getByFullName(main); other != nil && other != buf && other.Number > buf.Number {
+			index = i
+			break
+		}
+	}
+	w.List.InsertItem(index, buf.FullName, "", 0, nil)
+}
@@ -3,11 +3,13 @@ package client
 import (
 	"fmt"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/gen2brain/beeep"
 	"github.com/maxking/weeclient/src/color"
 	"github.com/maxking/weeclient/src/weechat"
+	"github.com/maxking/weeclient/src/weechat/commands"
 	"github.com/rivo/tview"
 )
 
@@ -27,6 +29,16 @@ func (tv *TerminalView) HandleListBuffers(buflist map[string]*weechat.WeechatBuf
 // Handles a new buffer opened. This is called several times during the
 // startup when the application boots up.
 func (tv *TerminalView) HandleBufferOpened(ptr string, buf *weechat.WeechatBuffer) {
+	// After a reconnection the buffers are listed again, keep their views
+	// and only apply what changed while we were disconnected.
+	if known, ok := tv.bufferList.Buffers[ptr]; ok {
+		tv.HandleBufferRenamed(buf)
+		tv.HandleBufferTitleChanged(buf)
+		if known.Number != buf.Number {
+			tv.HandleBufferMoved(buf)
+		}
+		return
+	}
 	// Add a new item to the List widget.
 	tv.bufferList.AddBuffer(buf.FullName)
 
@@ -49,10 +61,12 @@ func (tv *TerminalView) HandleBufferOpened(ptr string, buf *weechat.WeechatBuffe
 	input.SetDoneFunc(func(key tcell.Key) {
 		switch key {
 		case tcell.KeyEnter:
-			sendobj := &weechat.WeechatSendMessage{
-				Message: input.GetText(),
-				Buffer:  buf.FullName}
-			tv.sendchan <- sendobj.String()
+			cmd, err := commands.Input(buf.FullName, input.GetText())
+			if err != nil {
+				tv.Debug(fmt.Sprintf("Failed to send to %v: %v\n", buf.FullName, err))
+				return
+			}
+			tv.sendchan <- cmd
 			input.SetText("")
 		case tcell.KeyEscape:
 			input.SetText("")
@@ -76,7 +90,7 @@ func (tv *TerminalView) HandleBufferOpened(ptr string, buf *weechat.WeechatBuffe
 	// Buffer is a weechat buffer object, which includes the WeechatBuffer object
 	// and all the widgets associated with a single buffer window. In future, this
 	// will grow to add more widgets like nicklist for example.
-	buffer := &Buffer{WeechatBuffer: buf, Input: input, Chat: bufferView, NickList: nicklist}
+	buffer := &Buffer{WeechatBuffer: buf, Input: input, Chat: bufferView, NickList: nicklist, Layout: layout}
 	tv.bufferList.Buffers[ptr] = buffer
 
 	// The main biffer view page.
@@ -85,43 +99,7 @@ func (tv *TerminalView) HandleBufferOpened(ptr string, buf *weechat.WeechatBuffe
 	// TextView() doesn't auto-refresh when text is added to it. Make sure to
 	// refresh it manually.
 	bufferView.SetChangedFunc(func() {
-		indices := tv.bufferList.List.FindItems(buf.FullName, "", true, false)
-		if len(indices) == 0 {
-			tv.Debug(fmt.Sprintf("Failed to find the buffer for the name %v count: %v\n", buf.FullName, len(indices)))
-			return
-		}
-		// If more than one matched, find the exact match, otherwise, foud
-		// represent the index of the buffer.
-		var found int
-		if len(indices) > 1 {
-			found = indices[0]
-			for _, index := range indices {
-				main, _ := tv.bufferList.List.GetItemText(index)
-				if color.RemoveColor(main) == buf.FullName {
-					found = index
-					break
-				}
-			}
-		} else {
-			found = indices[0]
-		}
-		// Don't do anything if this is the current buffer. Usually,
-		// ChangedFunc is called when some text is added and also
-		// when the current view is selected as the current item. Hence
-		// we need to check for ourselves.
-		current := tv.bufferList.List.GetCurrentItem()
-		if current == found {
-			tv.app.Draw()
-			return
-		}
-		tv.app.QueueUpdateDraw(func() {
-			// Mark the buffer color.
-			tv.bufferList.List.SetItemText(
-				found,
-				fmt.Sprintf("[%v]%v[%v]",
-					color.UnreadColor, buf.FullName, color.DefaultColor), "")
-		})
-
+		tv.markUnread(buf.FullName)
 	})
 
 	// Add keybindings to switch between input and chat for focus.
@@ -138,7 +116,7 @@ func (tv *TerminalView) HandleBufferOpened(ptr string, buf *weechat.WeechatBuffe
 	// Finally, add a new page for the current buffer. This makes it
 	// easy to switch between buffers but switching between pages. It
 	// uses a Grid as the primary
-	tv.pages.AddPage(fmt.Sprintf("page-%v", buf.FullName),
+	tv.pages.AddPage(pageName(buf.FullName),
 		layout,
 		true,
 		// Only the core.weechat buffer is visible at first.
@@ -156,7 +134,7 @@ func (tv *TerminalView) HandleNickList(buffer string, nicks []*weechat.WeechatNi
 			buf.NickList.Clear()
 		}
 		for _, nick := range nicks {
-			if !nick.Group && nick.Level == 0 {
+			if showNick(nick) {
 				buf.NickList.AddItem(nick.String(), "", 0, nil)
 				tv.app.Draw()
 			}
@@ -166,10 +144,234 @@ func (tv *TerminalView) HandleNickList(buffer string, nicks []*weechat.WeechatNi
 	}
 }
 
+// Handle the changes to a nicklist by only changing the nicks that
+// changed in the widget instead of rebuilding it. The state is already
+// updated, so it has the position of the added nicks. The changes are
+// ignored until the whole nicklist is fetched when opening the buffer.
+func (tv *TerminalView) HandleNickListDiff(buffer string, diff []*weechat.WeechatNickDiff) {
+	buf := tv.bufferList.Buffers[buffer]
+	if buf == nil {
+		tv.Debug(fmt.Sprintf("Failed to apply nicklist diff to buffer %v as buffer == nil\n", buffer))
+		return
+	}
+	if state, ok := tv.state.Buffer(buffer); !ok || !state.NicksLoaded {
+		return
+	}
+	added := make(map[string]bool)
+	for _, d := range diff {
+		if d.Group {
+			continue
+		}
+		switch d.Diff {
+		case weechat.NickDiffAdded:
+			added[d.Name] = true
+		case weechat.NickDiffRemoved:
+			delete(added, d.Name)
+			if index := nickIndex(buf.NickList, d.Name); index >= 0 {
+				buf.NickList.RemoveItem(index)
+			}
+		case weechat.NickDiffUpdated:
+			index := nickIndex(buf.NickList, d.Name)
+			switch {
+			case index >= 0 && showNick(&d.WeechatNick):
+				buf.NickList.SetItemText(index, d.String(), "")
+			case index >= 0:
+				buf.NickList.RemoveItem(index)
+			case showNick(&d.WeechatNick):
+				added[d.Name] = true
+			}
+		}
+	}
+	if len(added) > 0 {
+		state, ok := tv.state.Buffer(buffer)
+		if !ok {
+			return
+		}
+		// Insert the new nicks in the order of the state, so that the
+		// index of each one is right once the ones before it are in.
+		index := 0
+		for i := range state.Nicks {
+			nick := &state.Nicks[i]
+			if !showNick(nick) {
+				continue
+			}
+			if added[nick.Name] {
+				buf.NickList.InsertItem(index, nick.String(), "", 0, nil)
+			}
+			index++
+		}
+	}
+	tv.app.Draw()
+}
+
+// Only nicks are shown in the nicklist widget, not the groups.
+func showNick(nick *weechat.WeechatNick) bool {
+	return !nick.Group && nick.Level == 0
+}
+
+// Index of the nick with the name in the nicklist widget, where it is
+// shown with its prefix, -1 if it isn't there.
+func nickIndex(list *tview.List, name string) int {
+	// Look for the nick without a prefix first, so that "bob" doesn't
+	// match the nick "xbob".
+	for i := 0; i < list.GetItemCount(); i++ {
+		if main, _ := list.GetItemText(i); main == name {
+			return i
+		}
+	}
+	for i := 0; i < list.GetItemCount(); i++ {
+		main, _ := list.GetItemText(i)
+		if _, size := utf8.DecodeRuneInString(main); main[size:] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Handle a buffer being closed by removing it from the buffer list and
+// removing its page.
+func (tv *TerminalView) HandleBufferClosing(wbuf *weechat.WeechatBuffer) {
+	buf := tv.eventBuffer("_buffer_closing", wbuf)
+	if buf == nil {
+		return
+	}
+	tv.removeBuffer(buf)
+}
+
+// Remove the buffer from the buffer list along with its page.
+func (tv *TerminalView) removeBuffer(buf *Buffer) {
+	tv.app.QueueUpdateDraw(func() {
+		tv.bufferList.RemoveBuffer(buf.FullName)
+		tv.pages.RemovePage(pageName(buf.FullName))
+	})
+	delete(tv.buffers, buf.FullName)
+	delete(tv.bufferList.Buffers, buf.Path)
+}
+
+// Handle a renamed buffer, the page and views are keyed by the full name
+// so they move to the new name.
+func (tv *TerminalView) HandleBufferRenamed(wbuf *weechat.WeechatBuffer) {
+	buf := tv.eventBuffer("_buffer_renamed", wbuf)
+	if buf == nil {
+		return
+	}
+	oldName := buf.FullName
+	buf.FullName = wbuf.FullName
+	buf.ShortName = wbuf.ShortName
+	buf.LocalVars = wbuf.LocalVars
+	if oldName == buf.FullName {
+		return
+	}
+
+	if view, ok := tv.buffers[oldName]; ok {
+		delete(tv.buffers, oldName)
+		tv.buffers[buf.FullName] = view
+	}
+	tv.app.QueueUpdateDraw(func() {
+		tv.bufferList.RenameBuffer(oldName, buf.FullName)
+		front, _ := tv.pages.GetFrontPage()
+		tv.pages.RemovePage(pageName(oldName))
+		tv.pages.AddPage(pageName(buf.FullName), buf.Layout, true, front == pageName(oldName))
+		buf.Chat.SetTitle(buf.FullName)
+		tv.renderBuffer(buf, buf.Chat)
+	})
+}
+
+// Handle a new title by showing it at the top of the buffer.
+func (tv *TerminalView) HandleBufferTitleChanged(wbuf *weechat.WeechatBuffer) {
+	if buf := tv.eventBuffer("_buffer_title_changed", wbuf); buf != nil {
+		buf.Title = wbuf.Title
+		tv.app.QueueUpdateDraw(func() {
+			tv.renderBuffer(buf, buf.Chat)
+		})
+	}
+}
+
+// Handle a buffer moved to a new number by moving it in the buffer list.
+func (tv *TerminalView) HandleBufferMoved(wbuf *weechat.WeechatBuffer) {
+	if buf := tv.eventBuffer("_buffer_moved", wbuf); buf != nil {
+		buf.Number = wbuf.Number
+		if !buf.Hidden {
+			tv.app.QueueUpdateDraw(func() {
+				tv.bufferList.MoveBuffer(buf)
+			})
+		}
+	}
+}
+
+// Merged buffers share the number of the buffer they are merged with,
+// so merging and unmerging only moves the buffer in the buffer list.
+func (tv *TerminalView) HandleBufferMerged(wbuf *weechat.WeechatBuffer, merged bool) {
+	if buf := tv.eventBuffer("_buffer_merged", wbuf); buf != nil {
+		buf.Number = wbuf.Number
+		if !buf.Hidden {
+			tv.app.QueueUpdateDraw(func() {
+				tv.bufferList.MoveBuffer(buf)
+			})
+		}
+	}
+}
+
+// Handle a hidden buffer by removing it from the buffer list, its page
+// is kept until it is unhidden.
+func (tv *TerminalView) HandleBufferHidden(wbuf *weechat.WeechatBuffer, hidden bool) {
+	buf := tv.eventBuffer("_buffer_hidden", wbuf)
+	if buf == nil || buf.Hidden == hidden {
+		return
+	}
+	buf.Hidden = hidden
+	buf.Number = wbuf.Number
+	tv.app.QueueUpdateDraw(func() {
+		if hidden {
+			tv.bufferList.RemoveBuffer(buf.FullName)
+		} else {
+			tv.bufferList.MoveBuffer(buf)
+		}
+	})
+}
+
+// Handle a buffer switching between formatted and free content, which
+// is only kept for now.
+func (tv *TerminalView) HandleBufferTypeChanged(wbuf *weechat.WeechatBuffer) {
+	if buf := tv.eventBuffer("_buffer_type_changed", wbuf); buf != nil {
+		buf.Type = wbuf.Type
+	}
+}
+
+// Handle local variables added, changed or removed in a buffer by keeping
+// the new ones.
+func (tv *TerminalView) HandleBufferLocalvars(wbuf *weechat.WeechatBuffer) {
+	if buf := tv.eventBuffer("_buffer_localvar_changed", wbuf); buf != nil {
+		buf.LocalVars = wbuf.LocalVars
+	}
+}
+
+// Handle a cleared buffer by removing all the lines from its view.
+func (tv *TerminalView) HandleBufferCleared(wbuf *weechat.WeechatBuffer) {
+	if buf := tv.eventBuffer("_buffer_cleared", wbuf); buf != nil {
+		tv.app.QueueUpdateDraw(func() {
+			buf.Chat.SetText(buf.TitleStr(true))
+		})
+	}
+}
+
+// Find the buffer of an event, logging it in the debug buffer if it isn't
+// known.
+func (tv *TerminalView) eventBuffer(event string, wbuf *weechat.WeechatBuffer) *Buffer {
+	buf := tv.bufferList.Buffers[wbuf.Path]
+	if buf == nil {
+		tv.Debug(fmt.Sprintf("Failed to handle %v for buffer %v as buffer == nil\n", event, wbuf.FullName))
+	}
+	return buf
+}
+
 // Handle a _buffer_line_added event from Weechat server.
 func (tv *TerminalView) HandleLineAdded(line *weechat.WeechatLine) {
 	buf := tv.bufferList.Buffers[line.Buffer]
-	buf.Lines = append(buf.Lines, line)
+	if buf == nil {
+		tv.Debug(fmt.Sprintf("Failed to add line to buffer %v as buffer == nil\n", line.Buffer))
+		return
+	}
 	// Also, add the message to the current view.
 	if bufView, ok := tv.buffers[buf.FullName]; ok {
 		bufView.Write([]byte("\n" + line.ToString(true)))
@@ -180,13 +382,78 @@ func (tv *TerminalView) HandleLineAdded(line *weechat.WeechatLine) {
 	}
 }
 
+// Mark the buffer as unread in the buffer list, unless it is the current
+// buffer. This is called from the changed func of the chat views, which
+// tview runs in its own goroutine, so the list is only used in the update.
+func (tv *TerminalView) markUnread(fullName string) {
+	tv.app.QueueUpdateDraw(func() {
+		indices := tv.bufferList.List.FindItems(fullName, "", true, false)
+		if len(indices) == 0 {
+			tv.Debug(fmt.Sprintf("Failed to find the buffer for the name %v count: %v\n", fullName, len(indices)))
+			return
+		}
+		// If more than one matched, find the exact match, otherwise, foud
+		// represent the index of the buffer.
+		var found int
+		if len(indices) > 1 {
+			found = indices[0]
+			for _, index := range indices {
+				main, _ := tv.bufferList.List.GetItemText(index)
+				if color.RemoveColor(main) == fullName {
+					found = index
+					break
+				}
+			}
+		} else {
+			found = indices[0]
+		}
+		// Don't do anything if this is the current buffer. Usually,
+		// ChangedFunc is called when some text is added and also
+		// when the current view is selected as the current item. Hence
+		// we need to check for ourselves.
+		if tv.bufferList.List.GetCurrentItem() == found {
+			return
+		}
+		// Mark the buffer color.
+		tv.bufferList.List.SetItemText(
+			found,
+			fmt.Sprintf("[%v]%v[%v]",
+				color.UnreadColor, fullName, color.DefaultColor), "")
+	})
+}
+
+// Handle the hotlist by marking the buffers with unread lines, the counts
+// are already in the state.
+func (tv *TerminalView) HandleHotlist(hotlist []*weechat.WeechatHotlist) {
+	for _, entry := range hotlist {
+		if buf := tv.bufferList.Buffers[entry.Buffer]; buf != nil {
+			tv.markUnread(buf.FullName)
+		}
+	}
+}
+
+// The Reconnector stops the events while Weechat upgrades, so there is
+// nothing to do but tell.
+func (tv *TerminalView) HandleUpgrade() {
+	tv.setStatus("upgrading weechat")
+}
+
+// All the pointers changed with the upgrade, so drop the buffers, the
+// Reconnector fetches them again along with their lines.
+func (tv *TerminalView) HandleUpgradeEnded() {
+	for _, buf := range tv.bufferList.Buffers {
+		tv.removeBuffer(buf)
+	}
+	tv.setStatus(weechat.ConnConnected.String())
+}
+
 // Default handler which handles all the unhandled messages.
 func (tv *TerminalView) Default(msg *weechat.WeechatMessage) {
 	tv.Debug(
 		fmt.Sprintf("Uhandled message MsgId: %v ObjType: %v Size: %v Value: %v\n",
 			msg.Msgid, msg.Type, msg.Size, msg.Object.Value))
-	if msg.Type == weechat.OBJ_HDA {
-		tv.Debug(msg.Object.Value.(weechat.WeechatHdaValue).DebugPrint())
+	if hda, err := msg.Object.Hdata(); err == nil {
+		tv.Debug(hda.DebugPrint())
 	}
 }
 
@@ -8,16 +8,28 @@ import (
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/maxking/weeclient/src/weechat"
+	"github.com/maxking/weeclient/src/weechat/commands"
 	"github.com/rivo/tview"
 )
 
 type TerminalView struct {
 	app        *tview.Application
 	grid       *tview.Grid
-	sendchan   chan string
+	sendchan   chan commands.Command
 	bufferList *BufferListWidget
 	pages      *tview.Pages
 	buffers    map[string]*tview.TextView
+	// State of all the buffers, which the widgets render from.
+	state *weechat.State
+	// Status line at the bottom, with the state of the connection.
+	status *tview.TextView
+}
+
+// Show the text in the status line.
+func (tv *TerminalView) setStatus(text string) {
+	tv.app.QueueUpdateDraw(func() {
+		tv.status.SetText(text)
+	})
 }
 
 // Event handler when something in a buffer widget changes.
@@ -35,14 +47,19 @@ func (tv *TerminalView) SetCurrentBuffer(index int, mainText, secondaryText stri
 		// For the buffer widget, set the right number of lines.
 		if bufView, ok := tv.buffers[buf.FullName]; ok {
 			//			tv.app.QueueUpdate(func() {
-			bufView.SetText(buf.TitleStr(true) + buf.GetLines(true))
+			tv.renderBuffer(buf, bufView)
+			tv.state.MarkRead(buf.Path)
 			tv.bufferList.List.SetItemText(index, fmt.Sprintf("%v", buf.FullName), "")
 			// Then, switch to the page that is embedding the above buffer widget.
-			tv.pages.SwitchToPage(fmt.Sprintf("page-%v", buf.FullName))
-			// Send command to load nicklist of the buffer if there
-			// is no nicklist in it and it is a channel not person (# check)
-			if buf.FullName != "debug" && buf.NickList.GetItemCount() == 0 && strings.Contains(buf.FullName, "#") {
-				tv.sendchan <- fmt.Sprintf("(nicklist) nicklist %v\n", buf.FullName)
+			tv.pages.SwitchToPage(pageName(buf.FullName))
+			// Send command to load nicklist of the buffer if it
+			// wasn't loaded yet and it is a channel not person (# check)
+			state, ok := tv.state.Buffer(buf.Path)
+			loaded := ok && state.NicksLoaded
+			if buf.FullName != "debug" && !loaded && strings.Contains(buf.FullName, "#") {
+				if cmd, err := commands.Nicklist(buf.FullName); err == nil {
+					tv.sendchan <- cmd.WithID("nicklist")
+				}
 			}
 			// })
 		} else {
@@ -57,23 +74,66 @@ func (tv *TerminalView) SetCurrentBuffer(index int, mainText, secondaryText stri
 	}
 }
 
+// Set the text of the chat view of a buffer to its title and the lines in
+// the state.
+func (tv *TerminalView) renderBuffer(buf *Buffer, bufView *tview.TextView) {
+	var lines []*weechat.WeechatLine
+	if state, ok := tv.state.Buffer(buf.Path); ok {
+		lines = state.Lines
+	}
+	bufView.SetText(buf.TitleStr(true) + weechat.FormatLines(lines, true))
+}
+
+// Render all the buffers again from the state, after it got the lines of
+// all the buffers from listlines. The state drops the lines it already
+// has, so this doesn't duplicate them after a reconnection.
+func (tv *TerminalView) renderBuffers() {
+	tv.app.QueueUpdateDraw(func() {
+		for _, buf := range tv.bufferList.Buffers {
+			if bufView, ok := tv.buffers[buf.FullName]; ok {
+				tv.renderBuffer(buf, bufView)
+			}
+		}
+	})
+}
+
+// Remove the buffers that aren't in the state anymore, after listbuffers
+// when they were closed while we were disconnected.
+func (tv *TerminalView) removeClosedBuffers() {
+	for ptr, buf := range tv.bufferList.Buffers {
+		if _, ok := tv.state.Buffer(ptr); !ok {
+			tv.removeBuffer(buf)
+		}
+	}
+}
+
 func (tv *TerminalView) FocusBuffer(index int, mainText, SecondaryTest string, shortcut rune) {
 	tv.app.SetFocus(tv.pages)
 }
 
+// Maximum number of lines kept for each buffer.
+const maxLines = 1000
+
+// Start the terminal ui with the messages from the relay on weechan, the
+// commands to send on sendchan and the changes of the connection state
+// on states, which are shown in the status line.
 func TviewStart(
-	weechan chan *weechat.WeechatMessage, sendchan chan string) {
+	weechan <-chan *weechat.WeechatMessage, sendchan chan commands.Command,
+	states <-chan weechat.ConnEvent) {
 	app := tview.NewApplication()
 	bufffers := make(map[string]*Buffer)
 	buflist := NewBufferListWidget(bufffers)
 	bufferspage := tview.NewPages()
 	bufferViews := make(map[string]*tview.TextView, 100)
+	status := tview.NewTextView().SetText(weechat.ConnConnected.String())
 
 	grid := tview.NewGrid().
+		SetRows(-1, 1).
 		SetColumns(-1, -4).
 		SetBorders(true).
 		AddItem(buflist.List, 0, 0, 1, 1, 0, 0, true).
-		AddItem(bufferspage, 0, 1, 1, 1, 0, 0, false)
+		AddItem(bufferspage, 0, 1, 1, 1, 0, 0, false).
+		AddItem(status, 1, 0, 1, 2, 0, 0, false)
 
 	// Create a terminalview object which holds all the state
 	// for the current state of the terminal.
@@ -83,7 +143,9 @@ func TviewStart(
 		bufferList: buflist,
 		pages:      bufferspage,
 		buffers:    bufferViews,
-		sendchan:   sendchan}
+		sendchan:   sendchan,
+		state:      weechat.NewState(maxLines),
+		status:     status}
 	view.bufferList.List.SetChangedFunc(view.SetCurrentBuffer)
 	view.bufferList.List.SetSelectedFunc(view.FocusBuffer)
 
@@ -98,7 +160,26 @@ func TviewStart(
 	// Read from the weechat incoming queue and enquee for handling.
 	go func() {
 		for msg := range weechan {
-			weechat.HandleMessage(msg, view)
+			if err := view.state.Update(msg); err != nil {
+				view.Debug(fmt.Sprintf("Failed to update state with %v: %v\n", msg.Msgid, err))
+			}
+			if msg.Msgid == "listlines" {
+				view.renderBuffers()
+				continue
+			}
+			if err := weechat.HandleMessage(msg, view); err != nil {
+				view.Debug(fmt.Sprintf("Failed to handle message %v: %v\n", msg.Msgid, err))
+			}
+			if msg.Msgid == "listbuffers" {
+				view.removeClosedBuffers()
+			}
+		}
+	}()
+
+	// Show the connection state in the status line.
+	go func() {
+		for event := range states {
+			view.setStatus(event.String())
 		}
 	}()
 
@@ -3,21 +3,14 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"strings"
 
 	"github.com/maxking/weeclient/src/color"
 	"github.com/maxking/weeclient/src/weechat"
-)
-
-// Set of initial commands sent to weechat.
-const (
-	authCommand    = `init password=%v`
-	initialCommand = `(listbuffers) hdata buffer:gui_buffers(*) number,full_name,short_name,type,nicklist,title,local_variables,
-(listlines) hdata buffer:gui_buffers(*)/own_lines/last_line(-%(lines)d)/data date,displayed,prefix,message,buffer
-sync
-`
+	"github.com/maxking/weeclient/src/weechat/commands"
 )
 
 func init() {
@@ -32,67 +25,55 @@ func main() {
 	relay, _ := reader.ReadString('\n')
 	relay = strings.TrimSuffix(relay, "\n")
 
-	// conn, err := net.Dial("tcp", relay)
-	conn := weechat.WeechatConnFactory(weechat.WebsocketConnection, relay, "/weechat", true)
-	if err := conn.Connect(); err != nil {
-		fmt.Printf("Failed to connect to remote relay at %v: %v\n", relay, err)
-		os.Exit(1)
-	}
-
 	fmt.Printf("Enter password for %v\n> ", relay)
 	text, _ := reader.ReadString('\n')
 	// TODO: handle error.
 
-	err := conn.Write([]byte(fmt.Sprintf(authCommand, text)))
+	// Authenticate with the password hashed using the strongest algorithm
+	// the relay supports. If the relay asks for a TOTP, it is generated
+	// from the secret in WEECLIENT_TOTP_SECRET if set, otherwise we ask
+	// for it.
+	c, err := weechat.Dial(context.Background(), weechat.Options{
+		ConnType: weechat.WebsocketConnection,
+		Address:  relay,
+		SSL:      true,
+		Auth: weechat.AuthOptions{
+			Password:   strings.TrimSuffix(text, "\n"),
+			TotpSecret: os.Getenv("WEECLIENT_TOTP_SECRET"),
+			TotpPrompt: func() (string, error) {
+				fmt.Printf("Enter TOTP for %v\n> ", relay)
+				return reader.ReadString('\n')
+			},
+		},
+	})
 	if err != nil {
-		fmt.Println("Failed to send auth message")
+		fmt.Printf("Failed to connect to remote relay at %v: %v\n", relay, err)
 		os.Exit(1)
 	}
+	defer c.Close()
 
-	err = conn.Write([]byte(initialCommand))
+	for _, cmd := range weechat.InitialCommands(weechat.DefaultLines) {
+		if err := c.Command(cmd); err != nil {
+			fmt.Printf("Failed to send initial commands: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	events, err := c.Subscribe()
 	if err != nil {
-		fmt.Println("Failed to send auth message")
+		fmt.Printf("Failed to sync with the relay: %v\n", err)
 		os.Exit(1)
 	}
-	// fmt.Printf("<-- Sending (%v bytes) %v\n", num, string(initialCommand))
-
-	// if err != nil {
-	// 	fmt.Println("Failed to authenticate with remote weechat relay.")
-	// }
-	// fmt.Printf("<-- Sent %v bytes\n", num)
-
-	weeproto := weechat.Protocol{}
 
 	handler := TerminalPrintHandler{}
-	// weechan := make(chan *weechat.WeechatMessage)
-
 	go func() {
-		for {
-			// first, read the length of the next message and block on
-			// msgLen := make([]byte, 4)
-			// _, err = conn.ReadMessage(msgLen)
-			// if err != nil {
-			// 	fmt.Printf("Failed to read message length. %v", err)
-			// }
-			// length := int(binary.BigEndian.Uint32(msgLen)) - 4
-			// // now, read the complete message (msglen - 4 bytes for the length.)
-			// msg := make([]byte, length)
-			// _, err = conn.Read(msg)
-			// if err != nil {
-			// 	fmt.Printf("Failed to read message of lenth %v, err: %v", msgLen, err)
-			// }
-			msg, err := conn.Read()
-			if err != nil {
-				fmt.Printf("Failed to read message over websocket:%v\n", err)
-			}
-
-			weeMsg, err := weeproto.Decode(msg)
-			if err != nil {
-				fmt.Printf("Failed to decode message from weechat. %v\n", err)
-			} else {
-				weechat.HandleMessage(weeMsg, &handler)
+		for weeMsg := range events {
+			if weeMsg.Msgid == "error" {
+				fmt.Printf("Failed to decode message from weechat. %v\n", weeMsg.Object.Value)
+			} else if err := weechat.HandleMessage(weeMsg, &handler); err != nil {
+				fmt.Printf("Failed to handle message from weechat. %v\n", err)
 			}
 		}
+		fmt.Printf("Disconnected from the relay: %v\n", c.Err())
 	}()
 
 	for {
@@ -104,8 +85,12 @@ func main() {
 			break
 		}
 		if text != "\n" {
-			if err = conn.Write([]byte(text)); err != nil {
-				fmt.Println("Failed to send message.")
+			cmd, err := commands.Parse(text)
+			if err == nil {
+				err = c.Command(cmd)
+			}
+			if err != nil {
+				fmt.Printf("Failed to send message: %v\n", err)
 			}
 			fmt.Printf(color.Green+"<-- %v\n"+color.Reset, text)
 		}
@@ -133,10 +118,66 @@ func (mh *TerminalPrintHandler) HandleNickList(buffer string, nicks []*weechat.W
 	fmt.Printf("Nicklist %v: %v\n", buffer, nicks)
 }
 
+func (mh *TerminalPrintHandler) HandleNickListDiff(buffer string, diff []*weechat.WeechatNickDiff) {
+	for _, d := range diff {
+		fmt.Printf("Nicklist diff %v: %v%v\n", buffer, d.Diff, d.Name)
+	}
+}
+
 func (mh *TerminalPrintHandler) HandleLineAdded(line *weechat.WeechatLine) {
 	fmt.Printf(color.Cyan+"%: %v \n"+color.Reset, line.Buffer, line.ToString(false))
 }
 
+func (mh *TerminalPrintHandler) HandleHotlist(hotlist []*weechat.WeechatHotlist) {
+	for _, entry := range hotlist {
+		fmt.Printf("Hotlist %v: %v\n", entry.Buffer, entry.Count)
+	}
+}
+
+func (mh *TerminalPrintHandler) HandleBufferClosing(buf *weechat.WeechatBuffer) {
+	fmt.Printf(color.Red+"Buffer closed: %v\n"+color.Reset, buf.FullName)
+}
+
+func (mh *TerminalPrintHandler) HandleBufferRenamed(buf *weechat.WeechatBuffer) {
+	fmt.Printf(color.Red+"Buffer renamed: %v (%v)\n"+color.Reset, buf.FullName, buf.ShortName)
+}
+
+func (mh *TerminalPrintHandler) HandleBufferTitleChanged(buf *weechat.WeechatBuffer) {
+	fmt.Printf(color.Red+"Buffer title: %v: %v\n"+color.Reset, buf.FullName, buf.Title)
+}
+
+func (mh *TerminalPrintHandler) HandleBufferMoved(buf *weechat.WeechatBuffer) {
+	fmt.Printf(color.Red+"Buffer moved: %v to %v\n"+color.Reset, buf.FullName, buf.Number)
+}
+
+func (mh *TerminalPrintHandler) HandleBufferMerged(buf *weechat.WeechatBuffer, merged bool) {
+	fmt.Printf(color.Red+"Buffer merged: %v %v\n"+color.Reset, buf.FullName, merged)
+}
+
+func (mh *TerminalPrintHandler) HandleBufferHidden(buf *weechat.WeechatBuffer, hidden bool) {
+	fmt.Printf(color.Red+"Buffer hidden: %v %v\n"+color.Reset, buf.FullName, hidden)
+}
+
+func (mh *TerminalPrintHandler) HandleBufferTypeChanged(buf *weechat.WeechatBuffer) {
+	fmt.Printf(color.Red+"Buffer type: %v %v\n"+color.Reset, buf.FullName, buf.Type)
+}
+
+func (mh *TerminalPrintHandler) HandleBufferLocalvars(buf *weechat.WeechatBuffer) {
+	fmt.Printf(color.Red+"Buffer local variables: %v %v\n"+color.Reset, buf.FullName, buf.LocalVars)
+}
+
+func (mh *TerminalPrintHandler) HandleBufferCleared(buf *weechat.WeechatBuffer) {
+	fmt.Printf(color.Red+"Buffer cleared: %v\n"+color.Reset, buf.FullName)
+}
+
+func (mh *TerminalPrintHandler) HandleUpgrade() {
+	fmt.Println(color.Red + "Weechat is upgrading" + color.Reset)
+}
+
+func (mh *TerminalPrintHandler) HandleUpgradeEnded() {
+	fmt.Println(color.Red + "Weechat upgrade ended" + color.Reset)
+}
+
 func (mh *TerminalPrintHandler) Default(msg *weechat.WeechatMessage) {
 	fmt.Printf(color.Gray+"Msgid: %v size: %v\n"+color.Reset, msg.Msgid, msg.Size)
 }
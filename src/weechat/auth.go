@@ -0,0 +1,323 @@
+package weechat
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxking/weeclient/src/weechat/commands"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Password hash algorithms supported by the relay, from the weakest to
+// the strongest.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_handshake
+const (
+	HashPlain        = "plain"
+	HashSHA256       = "sha256"
+	HashSHA512       = "sha512"
+	HashPBKDF2SHA256 = "pbkdf2+sha256"
+	HashPBKDF2SHA512 = "pbkdf2+sha512"
+)
+
+// Msgid used for the handshake command, the relay answers with the same
+// msgid.
+const handshakeMsgid = "handshake"
+
+// Returned when the relay only supports sending the password in plain text
+// and AuthOptions doesn't allow it.
+var ErrPlainNotAllowed = errors.New("relay only supports plain text passwords")
+
+// Returned when the relay asks for a TOTP and AuthOptions has no way to
+// get one.
+var ErrTotpRequired = errors.New("relay requires a TOTP")
+
+// Returned when the relay doesn't answer the handshake in time, like the
+// relays older than weechat 2.9 which don't know the command.
+var ErrNoHandshake = errors.New("no reply to the handshake")
+
+// Time waited for the reply to the handshake by default.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// Options to authenticate with the relay.
+type AuthOptions struct {
+	Password string
+
+	// Allow sending the password in plain text if the relay doesn't
+	// support any of the hash algorithms, or doesn't know the handshake
+	// at all.
+	AllowPlain bool
+
+	// Time to wait for the reply to the handshake, DefaultHandshakeTimeout
+	// if 0.
+	HandshakeTimeout time.Duration
+
+	// Ways to get the TOTP when the relay asks for one, tried in order:
+	// a fixed code, a code generated from the base32 secret configured
+	// in the relay or a code returned by the prompt.
+	Totp       string
+	TotpSecret string
+	TotpPrompt func() (string, error)
+
+	// Compression algorithms to offer to the relay, from the most to
+	// the least preferred. Defaults to zstd, then zlib, then none. The
+	// relay picks the first one it supports.
+	Compression []string
+}
+
+// Get the TOTP to send in the init command.
+func (a *AuthOptions) totp() (string, error) {
+	switch {
+	case a.Totp != "":
+		return a.Totp, nil
+	case a.TotpSecret != "":
+		return TOTP(a.TotpSecret, time.Now())
+	case a.TotpPrompt != nil:
+		code, err := a.TotpPrompt()
+		if err != nil {
+			return "", fmt.Errorf("failed to read TOTP: %v", err)
+		}
+		return strings.TrimSpace(code), nil
+	default:
+		return "", ErrTotpRequired
+	}
+}
+
+// Hash algorithms offered to the relay in the handshake. The relay picks
+// the strongest one that it supports too.
+func (a *AuthOptions) algorithms() []string {
+	algos := []string{HashSHA256, HashSHA512, HashPBKDF2SHA256, HashPBKDF2SHA512}
+	if a.AllowPlain {
+		algos = append([]string{HashPlain}, algos...)
+	}
+	return algos
+}
+
+// Compression algorithms offered to the relay in the handshake.
+func (a *AuthOptions) compressions() []string {
+	if len(a.Compression) == 0 {
+		return []string{CompressionZstd, CompressionZlib, CompressionOff}
+	}
+	return a.Compression
+}
+
+// Command to start the handshake with the relay.
+func (a *AuthOptions) HandshakeCommand() (commands.Command, error) {
+	cmd, err := commands.Handshake(map[string]string{
+		"password_hash_algo": strings.Join(a.algorithms(), ":"),
+		"compression":        strings.Join(a.compressions(), ":"),
+	})
+	return cmd.WithID(handshakeMsgid), err
+}
+
+// Result of a handshake, as sent by the relay.
+type Handshake struct {
+	// Hash algorithm picked by the relay, empty if none of the offered
+	// algorithms are supported.
+	HashAlgo string
+	// Number of iterations for the PBKDF2 algorithms.
+	Iterations int
+	// Nonce from the relay, in hex.
+	Nonce string
+	// Whether the relay asks for a TOTP in the init command.
+	Totp bool
+	// Compression picked by the relay for the messages it sends, "off"
+	// if the relay doesn't compress them.
+	Compression string
+}
+
+// Parse the reply of the relay to the handshake command, which is a
+// hashtable with string keys and values.
+func ParseHandshake(msg *WeechatMessage) (*Handshake, error) {
+	htb, err := msg.Object.Hashtable()
+	if err != nil {
+		return nil, fmt.Errorf("invalid handshake reply: %w", err)
+	}
+	values := make(map[string]string, len(htb))
+	for k, v := range htb {
+		key, _ := k.String()
+		value, _ := v.String()
+		values[key] = value
+	}
+	hs := &Handshake{
+		HashAlgo:    values["password_hash_algo"],
+		Nonce:       values["nonce"],
+		Totp:        values["totp"] == "on",
+		Compression: values["compression"],
+	}
+	// Relays older than 3.5 don't support compression in the handshake.
+	if hs.Compression == "" {
+		hs.Compression = CompressionOff
+	}
+	if iterations, ok := values["password_hash_iterations"]; ok && iterations != "" {
+		if hs.Iterations, err = strconv.Atoi(iterations); err != nil {
+			return nil, fmt.Errorf("invalid password_hash_iterations %q in handshake", iterations)
+		}
+	}
+	return hs, nil
+}
+
+// Compute the init command for the algorithm picked by the relay in the
+// handshake. The password is sent in plain text only if it is allowed. If
+// the relay asks for a TOTP, it is added to the command.
+func (a *AuthOptions) InitCommand(hs *Handshake) (commands.Command, error) {
+	options, err := a.initPassword(hs)
+	if err != nil {
+		return commands.Command{}, err
+	}
+	if hs.Totp {
+		if options["totp"], err = a.totp(); err != nil {
+			return commands.Command{}, err
+		}
+	}
+	return commands.Init(options)
+}
+
+// The password or password_hash option of the init command.
+func (a *AuthOptions) initPassword(hs *Handshake) (map[string]string, error) {
+	offered := false
+	for _, algo := range a.algorithms() {
+		offered = offered || algo == hs.HashAlgo
+	}
+	if !offered {
+		if hs.HashAlgo == "" || hs.HashAlgo == HashPlain {
+			return nil, ErrPlainNotAllowed
+		}
+		return nil, fmt.Errorf("relay picked unsupported password hash algorithm %q", hs.HashAlgo)
+	}
+	if hs.HashAlgo == HashPlain {
+		return map[string]string{"password": a.Password}, nil
+	}
+
+	clientNonce := make([]byte, 16)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return nil, fmt.Errorf("failed to generate client nonce: %v", err)
+	}
+	serverNonce, err := hex.DecodeString(hs.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce %q in handshake", hs.Nonce)
+	}
+	// The salt is the server nonce followed by the client nonce.
+	salt := append(serverNonce, clientNonce...)
+	hash, err := HashPassword(hs.HashAlgo, a.Password, salt, hs.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"password_hash": hash}, nil
+}
+
+// Hash the password with the salt, as expected in the password_hash option
+// of the init command. The result is "algo:salt:hash" or, for PBKDF2,
+// "algo:salt:iterations:hash", with the salt and hash in hex.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_init
+func HashPassword(algo string, password string, salt []byte, iterations int) (string, error) {
+	var newHash func() hash.Hash
+	switch algo {
+	case HashSHA256, HashPBKDF2SHA256:
+		newHash = sha256.New
+	case HashSHA512, HashPBKDF2SHA512:
+		newHash = sha512.New
+	default:
+		return "", fmt.Errorf("unsupported password hash algorithm %q", algo)
+	}
+
+	switch algo {
+	case HashSHA256, HashSHA512:
+		h := newHash()
+		h.Write(salt)
+		h.Write([]byte(password))
+		return fmt.Sprintf("%v:%x:%x", algo, salt, h.Sum(nil)), nil
+	default:
+		if iterations <= 0 {
+			return "", fmt.Errorf("invalid number of iterations %v for %v", iterations, algo)
+		}
+		key := pbkdf2.Key([]byte(password), salt, iterations, newHash().Size(), newHash)
+		return fmt.Sprintf("%v:%x:%v:%x", algo, salt, iterations, key), nil
+	}
+}
+
+// Authenticate with the relay on a connected conn. It sends the handshake,
+// reads messages until the reply to it and then sends the init command
+// with the password hashed using the strongest algorithm that both
+// support. It must be called before anything else reads from conn. The
+// relay doesn't reply to init, if the password is wrong it closes the
+// connection. Without a reply to the handshake in time it returns
+// ErrNoHandshake, the conn can't be used anymore then.
+func Authenticate(conn WeechatConn, opts AuthOptions) (*Handshake, error) {
+	handshake, err := opts.HandshakeCommand()
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Write([]byte(handshake.String())); err != nil {
+		return nil, fmt.Errorf("failed to send handshake: %v", err)
+	}
+	timeout := opts.HandshakeTimeout
+	if timeout == 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	var proto Protocol
+	var hs *Handshake
+	for hs == nil {
+		data, err := conn.Read()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("%w after %v, the relay may be older than weechat 2.9", ErrNoHandshake, timeout)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read handshake reply: %w", err)
+		}
+		msg, err := proto.Decode(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode handshake reply: %w", err)
+		}
+		if msg.Msgid != handshakeMsgid {
+			continue
+		}
+		if hs, err = ParseHandshake(msg); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return hs, err
+	}
+	init, err := opts.InitCommand(hs)
+	if err != nil {
+		return hs, err
+	}
+	if err := conn.Write([]byte(init.String())); err != nil {
+		return hs, fmt.Errorf("failed to send init: %v", err)
+	}
+	return hs, nil
+}
+
+// Authenticate with a relay older than weechat 2.9, which doesn't know
+// the handshake, by sending the password in plain text in the init
+// command. It fails with ErrPlainNotAllowed unless AllowPlain is set.
+// Without the handshake the relay can't ask for a TOTP, so one is sent
+// whenever the options have a way to get it.
+func AuthenticatePlain(conn WeechatConn, opts AuthOptions) error {
+	hs := &Handshake{
+		HashAlgo:    HashPlain,
+		Totp:        opts.Totp != "" || opts.TotpSecret != "" || opts.TotpPrompt != nil,
+		Compression: CompressionOff,
+	}
+	init, err := opts.InitCommand(hs)
+	if err != nil {
+		return err
+	}
+	if err := conn.Write([]byte(init.String())); err != nil {
+		return fmt.Errorf("failed to send init: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package weechat_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/maxking/weeclient/src/weechat"
+	"github.com/maxking/weeclient/src/weechat/relaytest"
+)
+
+func TestHashPassword(t *testing.T) {
+	// The example of the weechat relay protocol documentation.
+	salt := []byte("\x85\xb1\xee\x00\x69\x5a\x5b\x25\x4e\x14\xf4\x88\x55\x38\xdf\x0d\xa4\xb7\x32\x07\xf5\xaa\xe4")
+	tests := []struct {
+		algo       string
+		iterations int
+		want       string
+	}{
+		{weechat.HashSHA256, 0, "sha256:85b1ee00695a5b254e14f4885538df0da4b73207f5aae4:" +
+			"2c6ed12eb0109fca3aedc03bf03d9b6e804cd60a23e1731fd17794da423e21db"},
+		{weechat.HashSHA512, 0, "sha512:85b1ee00695a5b254e14f4885538df0da4b73207f5aae4:" +
+			"0a1f0172a542916bd86e0cbceebc1c38ed791f6be246120452825f0d74ef1078" +
+			"c79e9812de8b0ab3dfaf598b6ca14522374ec6a8653a46df3f96a6b54ac1f0f8"},
+		{weechat.HashPBKDF2SHA256, 100000, "pbkdf2+sha256:85b1ee00695a5b254e14f4885538df0da4b73207f5aae4:100000:" +
+			"ba7facc3edb89cd06ae810e29ced85980ff36de2bb596fcf513aaab626876440"},
+		{weechat.HashPBKDF2SHA512, 100000, "pbkdf2+sha512:85b1ee00695a5b254e14f4885538df0da4b73207f5aae4:100000:" +
+			"5bd4b3d0c2a58bef25fe4f40b5170d3cff88b33ca9556d850ef275be4a387eaa" +
+			"122ff5a406798b84feb93886e41cd800206833ad86c196b9ab86e3738f13702d"},
+	}
+	for _, tt := range tests {
+		got, err := weechat.HashPassword(tt.algo, "test", salt, tt.iterations)
+		if err != nil || got != tt.want {
+			t.Errorf("HashPassword(%v) = %v, %v, want %v", tt.algo, got, err, tt.want)
+		}
+	}
+	if _, err := weechat.HashPassword(weechat.HashPBKDF2SHA256, "test", salt, 0); err == nil {
+		t.Errorf("HashPassword() without iterations error = nil")
+	}
+	if _, err := weechat.HashPassword("md5", "test", salt, 0); err == nil {
+		t.Errorf("HashPassword() with an unknown algorithm error = nil")
+	}
+}
+
+// Connect to the fake relay and authenticate, then check the relay
+// answers a command, which it only does after a successful init.
+func authenticate(s *relaytest.Server, connType weechat.ConnectionType, opts weechat.AuthOptions) (*weechat.Handshake, error) {
+	conn := s.Conn(connType)
+	if err := conn.Connect(context.Background()); err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	hs, err := weechat.Authenticate(conn, opts)
+	if err != nil {
+		return hs, err
+	}
+	if err := conn.Write([]byte("(ping) ping\n")); err != nil {
+		return hs, err
+	}
+	_, err = conn.Read()
+	return hs, err
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		hashAlgos  []string
+		allowPlain bool
+		want       string
+		wantErr    error
+	}{
+		{"strongest", nil, false, weechat.HashPBKDF2SHA512, nil},
+		{"sha256", []string{weechat.HashPlain, weechat.HashSHA256}, false, weechat.HashSHA256, nil},
+		{"sha512", []string{weechat.HashPlain, weechat.HashSHA512}, true, weechat.HashSHA512, nil},
+		{"pbkdf2+sha256", []string{weechat.HashPlain, weechat.HashPBKDF2SHA256}, false, weechat.HashPBKDF2SHA256, nil},
+		{"plain allowed", []string{weechat.HashPlain}, true, weechat.HashPlain, nil},
+		{"plain not allowed", []string{weechat.HashPlain}, false, "", weechat.ErrPlainNotAllowed},
+	}
+	for _, tt := range tests {
+		for connName, connType := range map[string]weechat.ConnectionType{
+			"relay":     weechat.RelayConnection,
+			"websocket": weechat.WebsocketConnection,
+		} {
+			t.Run(tt.name+"/"+connName, func(t *testing.T) {
+				s := relaytest.NewServer("secret,with=chars")
+				defer s.Close()
+				if tt.hashAlgos != nil {
+					s.HashAlgos = tt.hashAlgos
+				}
+				opts := weechat.AuthOptions{Password: "secret,with=chars", AllowPlain: tt.allowPlain}
+				_, err := authenticate(s, connType, opts)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				if logins := s.Logins(); len(logins) != 1 || logins[0] != tt.want {
+					t.Errorf("Logins() = %v, want [%v]", logins, tt.want)
+				}
+
+				// The relay closes the connection after a wrong password.
+				opts.Password = "wrong"
+				if _, err := authenticate(s, connType, opts); err == nil {
+					t.Errorf("Authenticate() with a wrong password error = nil")
+				}
+			})
+		}
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// The SHA1 test vectors of RFC 6238, with 6 digits.
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got, err := weechat.TOTP(secret, time.Unix(tt.unix, 0)); err != nil || got != tt.want {
+			t.Errorf("TOTP(%v) = %v, %v, want %v", tt.unix, got, err, tt.want)
+		}
+	}
+	if _, err := weechat.TOTP("not base32!", time.Now()); err == nil {
+		t.Errorf("TOTP() with an invalid secret error = nil")
+	}
+}
+
+func TestAuthenticateTotp(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXP"
+	code, err := weechat.TOTP(secret, time.Now())
+	if err != nil {
+		t.Fatalf("TOTP() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		auth    weechat.AuthOptions
+		wantErr error
+	}{
+		{"secret", weechat.AuthOptions{TotpSecret: secret}, nil},
+		{"code", weechat.AuthOptions{Totp: code}, nil},
+		{"prompt", weechat.AuthOptions{TotpPrompt: func() (string, error) { return " " + code + "\n", nil }}, nil},
+		{"no way to get it", weechat.AuthOptions{}, weechat.ErrTotpRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := relaytest.NewServer("secret")
+			defer s.Close()
+			s.TotpSecret = secret
+			tt.auth.Password = "secret"
+			if _, err := authenticate(s, weechat.WebsocketConnection, tt.auth); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The relay closes the connection after a wrong code.
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	s.TotpSecret = secret
+	if _, err := authenticate(s, weechat.RelayConnection, weechat.AuthOptions{Password: "secret", Totp: "000000"}); err == nil {
+		t.Errorf("Authenticate() with a wrong code error = nil")
+	}
+}
+
+func TestHandshakeCompression(t *testing.T) {
+	tests := []struct {
+		name    string
+		offered []string
+		relay   []string
+		want    string
+	}{
+		{"default", nil, nil, weechat.CompressionZstd},
+		{"zlib offered", []string{weechat.CompressionZlib, weechat.CompressionOff}, nil, weechat.CompressionZlib},
+		{"zlib supported", nil, []string{weechat.CompressionZlib, weechat.CompressionOff}, weechat.CompressionZlib},
+		{"off", []string{weechat.CompressionOff}, nil, weechat.CompressionOff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := relaytest.NewServer("secret")
+			defer s.Close()
+			if tt.relay != nil {
+				s.Compressions = tt.relay
+			}
+			conn := s.Conn(weechat.RelayConnection)
+			if err := conn.Connect(context.Background()); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer conn.Close()
+			hs, err := weechat.Authenticate(conn, weechat.AuthOptions{Password: "secret", Compression: tt.offered})
+			if err != nil || hs.Compression != tt.want {
+				t.Fatalf("Authenticate() = %+v, %v, want the compression %v", hs, err, tt.want)
+			}
+
+			// The messages sent after the handshake are compressed.
+			if err := conn.Write([]byte("(buffers) hdata buffer:gui_buffers(*) full_name\n")); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			data, err := conn.Read()
+			if err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			var p weechat.Protocol
+			msg, err := p.Decode(data)
+			if err != nil || msg.Msgid != "buffers" || msg.Compression != tt.want {
+				t.Errorf("Decode() = %+v, %v, want buffers compressed with %v", msg, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialWithoutHandshake(t *testing.T) {
+	for name, connType := range map[string]weechat.ConnectionType{
+		"relay":     weechat.RelayConnection,
+		"websocket": weechat.WebsocketConnection,
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := relaytest.NewServer("secret")
+			defer s.Close()
+			s.NoHandshake = true
+			opts := weechat.Options{
+				ConnType: connType,
+				Address:  relayAddr(s, connType),
+				Auth:     weechat.AuthOptions{Password: "secret", HandshakeTimeout: 100 * time.Millisecond},
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if _, err := weechat.Dial(ctx, opts); !errors.Is(err, weechat.ErrNoHandshake) {
+				t.Fatalf("Dial() error = %v, want ErrNoHandshake", err)
+			}
+			if logins := s.Logins(); len(logins) != 0 {
+				t.Errorf("Logins() = %v, want none without AllowPlain", logins)
+			}
+
+			opts.Auth.AllowPlain = true
+			c, err := weechat.Dial(ctx, opts)
+			if err != nil {
+				t.Fatalf("Dial() with AllowPlain error = %v", err)
+			}
+			defer c.Close()
+			if _, err := c.Buffers(ctx); err != nil {
+				t.Errorf("Buffers() error = %v", err)
+			}
+			if logins := s.Logins(); len(logins) != 1 || logins[0] != weechat.HashPlain {
+				t.Errorf("Logins() = %v, want [plain]", logins)
+			}
+		})
+	}
+}
+
+func TestDialWithoutHandshakeTotp(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXP"
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	s.NoHandshake = true
+	s.TotpSecret = secret
+	opts := weechat.Options{
+		ConnType: weechat.RelayConnection,
+		Address:  s.Addr(),
+		Auth: weechat.AuthOptions{
+			Password:         "secret",
+			AllowPlain:       true,
+			HandshakeTimeout: 100 * time.Millisecond,
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := weechat.Dial(ctx, opts); !errors.Is(err, weechat.ErrAuthFailed) {
+		t.Fatalf("Dial() without a TOTP error = %v, want ErrAuthFailed", err)
+	}
+	for name, auth := range map[string]weechat.AuthOptions{
+		"secret": {TotpSecret: secret},
+		"prompt": {TotpPrompt: func() (string, error) { return weechat.TOTP(secret, time.Now()) }},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts := opts
+			opts.Auth.TotpSecret = auth.TotpSecret
+			opts.Auth.TotpPrompt = auth.TotpPrompt
+			c, err := weechat.Dial(ctx, opts)
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			c.Close()
+		})
+	}
+}
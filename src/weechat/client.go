@@ -0,0 +1,560 @@
+package weechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maxking/weeclient/src/weechat/commands"
+)
+
+// Returned by requests when the connection to the relay is lost before
+// the reply arrives.
+var ErrClientClosed = errors.New("connection to the relay is closed")
+
+// The connection is closed with this error, which wraps ErrClientClosed,
+// when more than maxQueuedEvents events are waiting to be read.
+var ErrEventsOverflow = fmt.Errorf("%w: too many unread events", ErrClientClosed)
+
+// Prefix of the ids assigned to requests, followed by a counter. Weechat
+// uses ids starting with an underscore for events, so these never clash
+// with them.
+const requestIDPrefix = "weeclient-"
+
+// Client sends commands to the relay on an authenticated WeechatConn and
+// routes the replies back to the caller by their message id. Sync events,
+// whose id starts with an underscore, and replies to commands sent with
+// Command() go to the Events() channel instead.
+//
+// A Client reads from the conn in its own goroutine, nothing else should
+// read from it once the Client is created.
+type Client struct {
+	conn  WeechatConn
+	proto Protocol
+
+	// Writes to a websocket aren't safe for concurrent use.
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[string]chan *WeechatMessage
+	err     error
+
+	events *eventQueue
+	done   chan struct{}
+}
+
+// Options to Dial a relay.
+type Options struct {
+	// Type of the connection, a direct relay connection or a websocket.
+	ConnType ConnectionType
+	// Address of the relay as host:port, or the path of the UNIX socket.
+	Address string
+	// Path of the websocket, defaults to /weechat.
+	Path string
+	// Use SSL, with the TLS settings of Conn.
+	SSL bool
+	// Extra settings of the connection.
+	Conn ConnOptions
+	// Password and TOTP to authenticate with.
+	Auth AuthOptions
+}
+
+// Returned by Dial when the relay closes the connection right after init,
+// which is how it rejects a wrong password or TOTP. An UpgradeError for a
+// 401 of the reverse proxy in front of a websocket relay matches it too.
+var ErrAuthFailed = errors.New("authentication with the relay failed")
+
+// Connect to the relay, authenticate and return a Client reading from the
+// connection. It pings the relay after init to make sure that the
+// password was accepted. A relay that doesn't answer the handshake, older
+// than weechat 2.9, fails with ErrNoHandshake unless AuthOptions allows
+// plain text passwords, then it connects again and sends the password in
+// plain text.
+func Dial(ctx context.Context, opts Options) (*Client, error) {
+	path := opts.Path
+	if path == "" && opts.ConnType == WebsocketConnection {
+		path = "/weechat"
+	}
+	connect := func() (WeechatConn, error) {
+		conn := NewConn(opts.ConnType, opts.Address, path, opts.SSL, opts.Conn)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return conn, conn.Connect(ctx)
+	}
+	conn, err := connect()
+	if err != nil {
+		return nil, err
+	}
+	// Authenticate doesn't take a context, closing the conn stops it.
+	stop := closeOnDone(ctx, conn)
+	_, err = Authenticate(conn, opts.Auth)
+	stop()
+	if errors.Is(err, ErrNoHandshake) && opts.Auth.AllowPlain && ctx.Err() == nil {
+		// A relay older than 2.9, the conn is broken by the timeout so
+		// connect again and only send init.
+		conn.Close()
+		if conn, err = connect(); err != nil {
+			return nil, err
+		}
+		stop = closeOnDone(ctx, conn)
+		err = AuthenticatePlain(conn, opts.Auth)
+		stop()
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := NewClient(conn)
+	if err := c.Ping(ctx); err != nil {
+		c.Close()
+		if errors.Is(err, ErrClientClosed) {
+			return nil, fmt.Errorf("%w: %v", ErrAuthFailed, err)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// Create a Client for a conn that is already connected and authenticated
+// and start reading messages from it.
+func NewClient(conn WeechatConn) *Client {
+	c := &Client{
+		conn:    conn,
+		pending: make(map[string]chan *WeechatMessage),
+		events:  newEventQueue(),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Channel of the messages that aren't replies to a request: sync events
+// like _buffer_line_added and replies to commands sent with Command().
+// Messages that fail to decode are sent with the msgid "error" and the
+// error as the Value of an object of type "error". The channel is closed
+// after the last event when the connection is lost, or right away by
+// Close, which drops the events that weren't read. It is buffered so
+// that a slow reader never blocks the replies to requests, but a reader
+// that falls more than maxQueuedEvents events behind loses the
+// connection with ErrEventsOverflow. Either read it until it is closed
+// or call Close.
+func (c *Client) Events() <-chan *WeechatMessage {
+	return c.events.out
+}
+
+// Closed when the connection to the relay is lost, Err() returns why.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// The error that ended the connection, nil while it is still alive.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Send a command without waiting for any reply. If the command has an id,
+// its reply goes to Events().
+func (c *Client) Command(cmd commands.Command) error {
+	return c.send(cmd, writeTimeout)
+}
+
+// How long a command can take to be sent, and the quit sent by Close.
+const (
+	writeTimeout = 30 * time.Second
+	closeTimeout = 5 * time.Second
+)
+
+// Send a command, failing if the relay doesn't read it within timeout
+// instead of blocking forever.
+func (c *Client) send(cmd commands.Command, timeout time.Duration) error {
+	data, err := commands.Encode(cmd)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	return c.conn.Write(data)
+}
+
+// Send a command with a new unique id and wait for the reply with the same
+// id. Any id already set in cmd is replaced.
+func (c *Client) Request(ctx context.Context, cmd commands.Command) (*WeechatMessage, error) {
+	id := c.newID()
+	return c.await(ctx, id, cmd.WithID(id))
+}
+
+// Get a new unique id for a request.
+func (c *Client) newID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	return requestIDPrefix + strconv.FormatUint(c.nextID, 10)
+}
+
+// Send cmd and wait for a reply with the msgid id.
+func (c *Client) await(ctx context.Context, id string, cmd commands.Command) (*WeechatMessage, error) {
+	reply := make(chan *WeechatMessage, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.pending[id] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.Command(cmd); err != nil {
+		return nil, err
+	}
+	select {
+	case msg := <-reply:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.Err()
+	}
+}
+
+// Request a hdata, with all the keys if there are none.
+func (c *Client) Hdata(ctx context.Context, path string, keys ...string) (*WeechatHdaValue, error) {
+	cmd, err := commands.Hdata(path, keys...)
+	if err != nil {
+		return nil, err
+	}
+	return c.requestHdata(ctx, cmd)
+}
+
+// Request the nicklist of a buffer, or of all buffers if it is empty.
+func (c *Client) Nicklist(ctx context.Context, buffer string) (*WeechatHdaValue, error) {
+	cmd, err := commands.Nicklist(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return c.requestHdata(ctx, cmd)
+}
+
+// Request the completion of data at position in a buffer.
+func (c *Client) Completion(ctx context.Context, buffer string, position int, data string) (*WeechatHdaValue, error) {
+	cmd, err := commands.Completion(buffer, position, data)
+	if err != nil {
+		return nil, err
+	}
+	return c.requestHdata(ctx, cmd)
+}
+
+func (c *Client) requestHdata(ctx context.Context, cmd commands.Command) (*WeechatHdaValue, error) {
+	msg, err := c.Request(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	hda, err := msg.Object.Hdata()
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply to %v: %w", cmd.Name, err)
+	}
+	return &hda, nil
+}
+
+// Request the value of an info, like "version". A NULL value, which the
+// relay sends for unknown infos, is returned as an empty string.
+func (c *Client) Info(ctx context.Context, name string, arguments string) (string, error) {
+	cmd, err := commands.Info(name, arguments)
+	if err != nil {
+		return "", err
+	}
+	msg, err := c.Request(ctx, cmd)
+	if err != nil {
+		return "", err
+	}
+	_, value, err := msg.Object.Info()
+	if err != nil {
+		return "", fmt.Errorf("invalid reply to info: %w", err)
+	}
+	return value, nil
+}
+
+// Request an infolist, optionally for a single pointer and with arguments.
+func (c *Client) Infolist(ctx context.Context, name string, pointer string, arguments string) (*WeechatInfolistValue, error) {
+	cmd, err := commands.Infolist(name, pointer, arguments)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := c.Request(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	inl, err := msg.Object.Infolist()
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply to infolist: %w", err)
+	}
+	return &inl, nil
+}
+
+// Keys of the buffers requested by Buffers().
+var bufferKeys = []string{"number", "full_name", "short_name", "type", "nicklist",
+	"title", "local_variables"}
+
+// Number of lines of each buffer fetched by InitialCommands by default.
+const DefaultLines = 15
+
+// Keys of the lines requested by InitialCommands.
+var lineKeys = []string{"date", "displayed", "notify_level", "highlight", "tags_array",
+	"prefix", "message", "buffer"}
+
+// Commands that fetch the buffers, the last lines of each buffer and the
+// hotlist, with the ids HandleMessage and State.Update expect. They are
+// sent once connected and again after Weechat upgrades, followed by a sync.
+func InitialCommands(lines int) []commands.Command {
+	return []commands.Command{
+		commands.Must(commands.Hdata("buffer:gui_buffers(*)", bufferKeys...)).WithID("listbuffers"),
+		commands.Must(commands.Hdata(fmt.Sprintf("buffer:gui_buffers(*)/own_lines/last_line(-%d)/data", lines),
+			lineKeys...)).WithID("listlines"),
+		commands.Must(commands.Hdata("hotlist:gui_hotlist(*)", "buffer", "count")).WithID("hotlist"),
+	}
+}
+
+// Get all the opened buffers.
+func (c *Client) Buffers(ctx context.Context) ([]*WeechatBuffer, error) {
+	hda, err := c.Hdata(ctx, "buffer:gui_buffers(*)", bufferKeys...)
+	if err != nil {
+		return nil, err
+	}
+	var buffers []*WeechatBuffer
+	if err := UnmarshalHdata(*hda, &buffers); err != nil {
+		return nil, err
+	}
+	for _, buf := range buffers {
+		buf.Lines = make([]*WeechatLine, 0)
+	}
+	return buffers, nil
+}
+
+// Send text to a buffer, given by its full name or pointer. Text starting
+// with a / is run as a command in the buffer. Each line of the text is
+// sent in its own input command, like when it is pasted in weechat, and
+// the empty lines are skipped.
+func (c *Client) Send(buffer string, text string) error {
+	var cmds []commands.Command
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool { return r == '\r' || r == '\n' }) {
+		cmd, err := commands.Input(buffer, line)
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, cmd)
+	}
+	if len(cmds) == 0 {
+		// Input reports the empty text and checks the buffer.
+		_, err := commands.Input(buffer, "")
+		return err
+	}
+	for _, cmd := range cmds {
+		if err := c.Command(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ask the relay to send events for all the buffers and return the channel
+// with them, which is the same as Events().
+func (c *Client) Subscribe() (<-chan *WeechatMessage, error) {
+	cmd, err := commands.Sync(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Command(cmd); err != nil {
+		return nil, err
+	}
+	return c.Events(), nil
+}
+
+// Tell the relay we are quitting and close the connection. It waits until
+// the reading goroutine stops and drops the events that weren't read, so
+// the Events() channel is closed once Close returns. Err() returns
+// ErrClientClosed afterwards.
+func (c *Client) Close() error {
+	var err error
+	select {
+	case <-c.done:
+	default:
+		err = c.send(commands.Quit(), closeTimeout)
+		// Closing the conn unblocks the Read of the reading goroutine.
+		c.conn.Close()
+		<-c.done
+	}
+	c.events.stop()
+	return err
+}
+
+// Ping the relay and wait for its _pong. The relay doesn't use the id of
+// the ping for the _pong, so the reply is matched by its arguments.
+func (c *Client) Ping(ctx context.Context) error {
+	id := c.newID()
+	cmd, err := commands.Ping(id)
+	if err != nil {
+		return err
+	}
+	_, err = c.await(ctx, pongKey(id), cmd)
+	return err
+}
+
+// Key in pending for the _pong with the given arguments.
+func pongKey(arguments string) string {
+	return "_pong " + arguments
+}
+
+// Read messages until the connection fails and route them to the pending
+// requests or to the events.
+func (c *Client) readLoop() {
+	defer c.events.close()
+	err := c.route()
+	if !errors.Is(err, ErrClientClosed) {
+		err = fmt.Errorf("%w: %v", ErrClientClosed, err)
+	}
+	// The Read may have failed without the conn being closed.
+	c.conn.Close()
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+	close(c.done)
+}
+
+func (c *Client) route() error {
+	for {
+		data, err := c.conn.Read()
+		if err != nil {
+			return err
+		}
+		msg, err := c.proto.Decode(data)
+		if err != nil {
+			msg = &WeechatMessage{
+				Msgid:  "error",
+				Object: WeechatObject{ObjType: "error", Value: err},
+			}
+			if err := c.events.push(msg); err != nil {
+				return err
+			}
+			continue
+		}
+		key := msg.Msgid
+		if key == "_pong" {
+			arguments, _ := msg.Object.String()
+			key = pongKey(arguments)
+		}
+		c.mu.Lock()
+		reply, ok := c.pending[key]
+		delete(c.pending, key)
+		c.mu.Unlock()
+		if ok {
+			reply <- msg
+			continue
+		}
+		if !strings.HasPrefix(msg.Msgid, requestIDPrefix) {
+			if err := c.events.push(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Most events waiting in an eventQueue, far more than a relay sends while
+// a reader handles one.
+const maxQueuedEvents = 10000
+
+// Queue that forwards messages to a channel, so that pushing doesn't block
+// on a slow reader until maxQueuedEvents are waiting.
+type eventQueue struct {
+	out chan *WeechatMessage
+	// Closed by stop to drop the queued messages, and once out is closed.
+	stopped  chan struct{}
+	finished chan struct{}
+	stopOnce sync.Once
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []*WeechatMessage
+	closed bool
+}
+
+func newEventQueue() *eventQueue {
+	q := &eventQueue{
+		out:      make(chan *WeechatMessage),
+		stopped:  make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	go q.forward()
+	return q
+}
+
+// Queue the message, failing with ErrEventsOverflow when the queue is
+// full.
+func (q *eventQueue) push(msg *WeechatMessage) error {
+	q.mu.Lock()
+	if len(q.queue) >= maxQueuedEvents {
+		q.mu.Unlock()
+		return ErrEventsOverflow
+	}
+	q.queue = append(q.queue, msg)
+	q.mu.Unlock()
+	q.cond.Signal()
+	return nil
+}
+
+// Close the channel once all the queued messages are delivered.
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// Drop the queued messages and wait until the channel is closed, so that
+// the forwarding goroutine stops even if nobody reads the channel.
+func (q *eventQueue) stop() {
+	q.stopOnce.Do(func() { close(q.stopped) })
+	q.close()
+	<-q.finished
+}
+
+func (q *eventQueue) forward() {
+	defer close(q.finished)
+	defer close(q.out)
+	for {
+		q.mu.Lock()
+		for len(q.queue) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.queue) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		msg := q.queue[0]
+		q.queue[0] = nil
+		q.queue = q.queue[1:]
+		q.mu.Unlock()
+		select {
+		case q.out <- msg:
+		case <-q.stopped:
+			return
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package weechat_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxking/weeclient/src/weechat"
+	"github.com/maxking/weeclient/src/weechat/commands"
+	"github.com/maxking/weeclient/src/weechat/relaytest"
+)
+
+// Dial the fake relay and fail the test if it doesn't work.
+func dial(t *testing.T, opts weechat.Options) *weechat.Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := weechat.Dial(ctx, opts)
+	if err != nil {
+		t.Fatalf("Dial(%v) error = %v", opts.Address, err)
+	}
+	return c
+}
+
+// Dial the direct relay connection of the fake relay.
+func dialRelay(t *testing.T, s *relaytest.Server) *weechat.Client {
+	t.Helper()
+	return dial(t, weechat.Options{
+		ConnType: weechat.RelayConnection,
+		Address:  s.Addr(),
+		Auth:     weechat.AuthOptions{Password: s.Password},
+	})
+}
+
+// Wait for the next event with the msgid, skipping the others.
+func nextEvent(t *testing.T, events <-chan *weechat.WeechatMessage, msgid string) *weechat.WeechatMessage {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-events:
+			if !ok {
+				t.Fatalf("events closed while waiting for %v", msgid)
+			}
+			if msg.Msgid == msgid {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %v", msgid)
+		}
+	}
+}
+
+func TestDial(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	socket := filepath.Join(t.TempDir(), "relay.sock")
+	if err := s.ListenUnix(socket); err != nil {
+		t.Fatalf("ListenUnix() error = %v", err)
+	}
+	tests := []struct {
+		name     string
+		connType weechat.ConnectionType
+		address  string
+	}{
+		{"relay", weechat.RelayConnection, s.Addr()},
+		{"websocket", weechat.WebsocketConnection, s.WebsocketAddr()},
+		{"unix", weechat.UnixSocketConnection, socket},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := weechat.Options{
+				ConnType: tt.connType,
+				Address:  tt.address,
+				Auth:     weechat.AuthOptions{Password: "wrong"},
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := weechat.Dial(ctx, opts); !errors.Is(err, weechat.ErrAuthFailed) {
+				t.Fatalf("Dial() with a wrong password error = %v, want ErrAuthFailed", err)
+			}
+
+			opts.Auth.Password = "secret"
+			c := dial(t, opts)
+			buffers, err := c.Buffers(ctx)
+			if err != nil || len(buffers) != 1 || buffers[0].FullName != "core.weechat" || buffers[0].Path == "" {
+				t.Fatalf("Buffers() = %+v, %v, want core.weechat", buffers, err)
+			}
+
+			events, err := c.Subscribe()
+			if err != nil {
+				t.Fatalf("Subscribe() error = %v", err)
+			}
+			if err := c.Send("core.weechat", "hello"); err != nil {
+				t.Fatalf("Send() error = %v", err)
+			}
+			msg := nextEvent(t, events, "_buffer_line_added")
+			hda, _ := msg.Object.Hdata()
+			var lines []*weechat.WeechatLine
+			if err := weechat.UnmarshalHdata(hda, &lines); err != nil || len(lines) != 1 || lines[0].Message != "hello" {
+				t.Errorf("line added = %+v, %v, want hello", lines, err)
+			}
+
+			if err := c.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			for range events {
+			}
+			if !errors.Is(c.Err(), weechat.ErrClientClosed) {
+				t.Errorf("Err() = %v, want ErrClientClosed", c.Err())
+			}
+		})
+	}
+}
+
+func TestClientConcurrentRequests(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	s.AddBuffer(&relaytest.Buffer{FullName: "irc.libera.#go", ShortName: "#go"})
+	c := dialRelay(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Every reply goes to the request with its msgid.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if hda, err := c.Hdata(ctx, "buffer:gui_buffers(*)", "full_name"); err != nil || len(hda.Value) != 2 {
+				t.Errorf("Hdata() = %v, %v, want 2 buffers", hda, err)
+			}
+			if version, err := c.Info(ctx, "version", ""); err != nil || version != "3.5" {
+				t.Errorf("Info() = %v, %v, want 3.5", version, err)
+			}
+			if err := c.Ping(ctx); err != nil {
+				t.Errorf("Ping() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	canceled, cancelNow := context.WithCancel(ctx)
+	cancelNow()
+	if _, err := c.Hdata(canceled, "buffer:gui_buffers(*)"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Hdata() with a canceled context error = %v, want context.Canceled", err)
+	}
+}
+
+func TestClientEvents(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	c := dialRelay(t, s)
+
+	// Replies to commands sent with their own id and sync events go to
+	// the events.
+	cmd := commands.Must(commands.Hdata("buffer:gui_buffers(*)", "full_name")).WithID("buffers")
+	if err := c.Command(cmd); err != nil {
+		t.Fatalf("Command() error = %v", err)
+	}
+	nextEvent(t, c.Events(), "buffers")
+	if err := c.Command(commands.Must(commands.Sync(nil))); err != nil {
+		t.Fatalf("Command() error = %v", err)
+	}
+	if err := c.Command(commands.Must(commands.Input("core.weechat", "hello"))); err != nil {
+		t.Fatalf("Command() error = %v", err)
+	}
+	nextEvent(t, c.Events(), "_buffer_line_added")
+
+	// The pending requests fail once the connection is lost.
+	s.Close()
+	<-c.Done()
+	for range c.Events() {
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.Hdata(ctx, "buffer:gui_buffers(*)"); !errors.Is(err, weechat.ErrClientClosed) {
+		t.Errorf("Hdata() after the connection is lost error = %v, want ErrClientClosed", err)
+	}
+}
+
+func TestClientSendLines(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	c := dialRelay(t, s)
+	defer c.Close()
+
+	// Each line is its own input, a newline could otherwise run the
+	// next line as a command.
+	if err := c.Send("core.weechat", "hello\r\n\n/quit\rbye\n"); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+	want := []relaytest.Input{
+		{Buffer: "core.weechat", Text: "hello"},
+		{Buffer: "core.weechat", Text: "/quit"},
+		{Buffer: "core.weechat", Text: "bye"},
+	}
+	if inputs := s.Inputs(); !reflect.DeepEqual(inputs, want) {
+		t.Errorf("Inputs() = %v, want %v", inputs, want)
+	}
+
+	for _, text := range []string{"", "\r\n"} {
+		if err := c.Send("core.weechat", text); !errors.Is(err, commands.ErrInvalidArgument) {
+			t.Errorf("Send(%q) error = %v, want ErrInvalidArgument", text, err)
+		}
+	}
+}
+
+func TestClientCloseWithoutReader(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	c := dialRelay(t, s)
+	events, err := c.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	for _, text := range []string{"one", "two", "three"} {
+		if err := c.Send("core.weechat", text); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+
+	// The events that weren't read are dropped and the channel is closed
+	// once Close returns.
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if msg, ok := <-events; ok {
+		t.Errorf("event %v after Close(), want the channel closed", msg.Msgid)
+	}
+}
+
+func TestClientEventsOverflow(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	c := dialRelay(t, s)
+	defer c.Close()
+	if _, err := c.Subscribe(); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+
+	// Nobody reads the events, the connection is dropped instead of
+	// queuing them forever.
+	msg := &weechat.WeechatMessage{Msgid: "_test", Object: weechat.WeechatObject{ObjType: weechat.OBJ_STR, Value: "x"}}
+	go func() {
+		for i := 0; i < 20000; i++ {
+			s.Push(msg)
+		}
+	}()
+	select {
+	case <-c.Done():
+	case <-ctx.Done():
+		t.Fatal("connection still alive with all the events unread")
+	}
+	if err := c.Err(); !errors.Is(err, weechat.ErrEventsOverflow) || !errors.Is(err, weechat.ErrClientClosed) {
+		t.Errorf("Err() = %v, want ErrEventsOverflow", err)
+	}
+}
@@ -0,0 +1,349 @@
+// Builders for the commands that clients send to the weechat relay.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#commands
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Returned, wrapped with the details, when an argument can't be sent in a
+// command as is.
+var ErrInvalidArgument = errors.New("invalid command argument")
+
+// Sync options to choose which events the relay sends.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_sync
+const (
+	SyncBuffers  = "buffers"
+	SyncUpgrade  = "upgrade"
+	SyncBuffer   = "buffer"
+	SyncNicklist = "nicklist"
+)
+
+// A single command to the relay. The relay answers with the same ID as
+// the msgid of its reply, commands without an ID get replies with an
+// empty msgid.
+type Command struct {
+	ID   string
+	Name string
+	Args []string
+}
+
+// Return a copy of the command with the given ID.
+func (c Command) WithID(id string) Command {
+	c.ID = id
+	return c
+}
+
+// Check that the command can be sent as a single line. The arguments are
+// already checked by the functions creating the command, so this mostly
+// checks the ID.
+func (c Command) Validate() error {
+	if strings.ContainsAny(c.ID, ") \t\r\n") {
+		return fmt.Errorf("%w: message id %q has spaces or a parenthesis", ErrInvalidArgument, c.ID)
+	}
+	if err := checkWord("command name", c.Name); err != nil {
+		return err
+	}
+	for _, arg := range c.Args {
+		if err := checkText(c.Name+" argument", arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Format the command as sent on the wire, "(id) name args..." with a
+// trailing newline. It doesn't validate the command, use Encode for that.
+func (c Command) String() string {
+	var b strings.Builder
+	if c.ID != "" {
+		fmt.Fprintf(&b, "(%v) ", c.ID)
+	}
+	b.WriteString(c.Name)
+	for _, arg := range c.Args {
+		if arg != "" {
+			b.WriteString(" ")
+			b.WriteString(arg)
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// Validate and encode the commands, one per line, to be sent in a single
+// write to the relay.
+func Encode(cmds ...Command) ([]byte, error) {
+	var b strings.Builder
+	for _, cmd := range cmds {
+		if err := cmd.Validate(); err != nil {
+			return nil, err
+		}
+		b.WriteString(cmd.String())
+	}
+	return []byte(b.String()), nil
+}
+
+// Parse a command typed by hand, like "(id) hdata buffer:gui_buffers(*)",
+// into a Command. Everything after the name is kept as a single argument.
+func Parse(line string) (Command, error) {
+	line = strings.TrimRight(line, "\r\n")
+	var cmd Command
+	if strings.HasPrefix(line, "(") {
+		end := strings.Index(line, ")")
+		if end < 0 {
+			return Command{}, fmt.Errorf("%w: unterminated message id in %q", ErrInvalidArgument, line)
+		}
+		cmd.ID = line[1:end]
+		line = strings.TrimLeft(line[end+1:], " ")
+	}
+	parts := strings.SplitN(line, " ", 2)
+	cmd.Name = parts[0]
+	if len(parts) > 1 {
+		cmd.Args = []string{parts[1]}
+	}
+	return cmd, cmd.Validate()
+}
+
+// Helper that wraps a call to a function returning (Command, error) and
+// panics if the error is non-nil. It is meant for commands built from
+// constants, like the initial commands of a client.
+func Must(cmd Command, err error) Command {
+	if err != nil {
+		panic(err)
+	}
+	return cmd
+}
+
+// Start the handshake, with options like password_hash_algo and
+// compression.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_handshake
+func Handshake(options map[string]string) (Command, error) {
+	opts, err := formatOptions(options)
+	if err != nil {
+		return Command{}, err
+	}
+	return Command{Name: "handshake", Args: []string{opts}}, nil
+}
+
+// Authenticate with options like password, password_hash and totp. Commas
+// in the values are escaped.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_init
+func Init(options map[string]string) (Command, error) {
+	opts, err := formatOptions(options)
+	if err != nil {
+		return Command{}, err
+	}
+	return Command{Name: "init", Args: []string{opts}}, nil
+}
+
+// Request a hdata, like "buffer:gui_buffers(*)" with the given keys or all
+// of them if there are none.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_hdata
+func Hdata(path string, keys ...string) (Command, error) {
+	if err := checkWord("hdata path", path); err != nil {
+		return Command{}, err
+	}
+	for _, key := range keys {
+		if err := checkWord("hdata key", key); err != nil {
+			return Command{}, err
+		}
+		if strings.Contains(key, ",") {
+			return Command{}, fmt.Errorf("%w: hdata key %q has a comma", ErrInvalidArgument, key)
+		}
+	}
+	return Command{Name: "hdata", Args: []string{path, strings.Join(keys, ",")}}, nil
+}
+
+// Request a single info, like "version", with optional arguments.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_info
+func Info(name string, arguments string) (Command, error) {
+	if err := checkWord("info name", name); err != nil {
+		return Command{}, err
+	}
+	if err := checkText("info arguments", arguments); err != nil {
+		return Command{}, err
+	}
+	return Command{Name: "info", Args: []string{name, arguments}}, nil
+}
+
+// Request an infolist, optionally for a single pointer and with
+// arguments. The pointer is "0" if only the arguments are given.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_infolist
+func Infolist(name string, pointer string, arguments string) (Command, error) {
+	if err := checkWord("infolist name", name); err != nil {
+		return Command{}, err
+	}
+	if pointer == "" && arguments != "" {
+		pointer = "0"
+	}
+	if pointer != "" {
+		if err := checkWord("infolist pointer", pointer); err != nil {
+			return Command{}, err
+		}
+	}
+	if err := checkText("infolist arguments", arguments); err != nil {
+		return Command{}, err
+	}
+	return Command{Name: "infolist", Args: []string{name, pointer, arguments}}, nil
+}
+
+// Request the nicklist of a buffer, given by its full name or pointer, or
+// of all the buffers if it is empty.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_nicklist
+func Nicklist(buffer string) (Command, error) {
+	if buffer != "" {
+		if err := checkWord("buffer", buffer); err != nil {
+			return Command{}, err
+		}
+	}
+	return Command{Name: "nicklist", Args: []string{buffer}}, nil
+}
+
+// Send text or a command to a buffer, given by its full name or pointer.
+// A command can't span lines, so the data can't have newlines, send each
+// line in its own input instead.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_input
+func Input(buffer string, data string) (Command, error) {
+	if err := checkWord("buffer", buffer); err != nil {
+		return Command{}, err
+	}
+	if data == "" {
+		return Command{}, fmt.Errorf("%w: empty input", ErrInvalidArgument)
+	}
+	if err := checkText("input", data); err != nil {
+		return Command{}, err
+	}
+	return Command{Name: "input", Args: []string{buffer, data}}, nil
+}
+
+// Request the completion of data at position in a buffer. A position of
+// -1 completes at the end of data.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_completion
+func Completion(buffer string, position int, data string) (Command, error) {
+	if err := checkWord("buffer", buffer); err != nil {
+		return Command{}, err
+	}
+	if position < -1 || position > len(data) {
+		return Command{}, fmt.Errorf("%w: completion position %v out of range", ErrInvalidArgument, position)
+	}
+	if err := checkText("completion data", data); err != nil {
+		return Command{}, err
+	}
+	return Command{Name: "completion", Args: []string{buffer, strconv.Itoa(position), data}}, nil
+}
+
+// Subscribe to events for the given buffers, all of them if there are
+// none. Without options the relay sends all the events.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_sync
+func Sync(buffers []string, options ...string) (Command, error) {
+	args, err := syncArgs(buffers, options)
+	if err != nil {
+		return Command{}, err
+	}
+	return Command{Name: "sync", Args: args}, nil
+}
+
+// Unsubscribe from events, the inverse of Sync.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_desync
+func Desync(buffers []string, options ...string) (Command, error) {
+	args, err := syncArgs(buffers, options)
+	if err != nil {
+		return Command{}, err
+	}
+	return Command{Name: "desync", Args: args}, nil
+}
+
+// Ask the relay for a message with one object of each type.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_test
+func Test() Command {
+	return Command{Name: "test"}
+}
+
+// Ping the relay, which answers with a _pong message with the same
+// arguments.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_ping
+func Ping(arguments string) (Command, error) {
+	if err := checkText("ping arguments", arguments); err != nil {
+		return Command{}, err
+	}
+	return Command{Name: "ping", Args: []string{arguments}}, nil
+}
+
+// Disconnect from the relay.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_quit
+func Quit() Command {
+	return Command{Name: "quit"}
+}
+
+func syncArgs(buffers []string, options []string) ([]string, error) {
+	for _, buf := range buffers {
+		if err := checkWord("buffer", buf); err != nil {
+			return nil, err
+		}
+		if strings.Contains(buf, ",") {
+			return nil, fmt.Errorf("%w: buffer %q has a comma", ErrInvalidArgument, buf)
+		}
+	}
+	for _, opt := range options {
+		switch opt {
+		case SyncBuffers, SyncUpgrade, SyncBuffer, SyncNicklist:
+		default:
+			return nil, fmt.Errorf("%w: unknown sync option %q", ErrInvalidArgument, opt)
+		}
+	}
+	if len(buffers) == 0 {
+		if len(options) == 0 {
+			return nil, nil
+		}
+		buffers = []string{"*"}
+	}
+	return []string{strings.Join(buffers, ","), strings.Join(options, ",")}, nil
+}
+
+// Format options as "name=value,..." sorted by name, escaping the commas
+// in the values.
+func formatOptions(options map[string]string) (string, error) {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		if err := checkWord("option name", name); err != nil {
+			return "", err
+		}
+		if strings.ContainsAny(name, ",=") {
+			return "", fmt.Errorf("%w: option name %q", ErrInvalidArgument, name)
+		}
+		if err := checkText("option "+name, options[name]); err != nil {
+			return "", err
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	opts := make([]string, 0, len(names))
+	for _, name := range names {
+		opts = append(opts, name+"="+strings.ReplaceAll(options[name], ",", "\\,"))
+	}
+	return strings.Join(opts, ","), nil
+}
+
+// Check a single word argument, which can't be empty or have spaces.
+func checkWord(what string, s string) error {
+	if s == "" {
+		return fmt.Errorf("%w: empty %v", ErrInvalidArgument, what)
+	}
+	if strings.ContainsAny(s, " \t\r\n") {
+		return fmt.Errorf("%w: %v %q has spaces", ErrInvalidArgument, what, s)
+	}
+	return nil
+}
+
+// Check a free text argument, which can't have newlines since they end
+// the command.
+func checkText(what string, s string) error {
+	if strings.ContainsAny(s, "\r\n") {
+		return fmt.Errorf("%w: %v has a newline", ErrInvalidArgument, what)
+	}
+	return nil
+}
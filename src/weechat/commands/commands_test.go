@@ -0,0 +1,143 @@
+package commands
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCommandString(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  Command
+		err  error
+		want string
+	}{
+		{"handshake", Must(Handshake(map[string]string{"password_hash_algo": "plain:sha256", "compression": "zstd"})), nil,
+			"handshake compression=zstd,password_hash_algo=plain:sha256\n"},
+		{"init escapes commas", Must(Init(map[string]string{"password": "a,b", "totp": "123456"})), nil,
+			"init password=a\\,b,totp=123456\n"},
+		{"hdata", Must(Hdata("buffer:gui_buffers(*)", "number", "full_name")), nil,
+			"hdata buffer:gui_buffers(*) number,full_name\n"},
+		{"hdata without keys", Must(Hdata("buffer:gui_buffers(*)")), nil, "hdata buffer:gui_buffers(*)\n"},
+		{"info", Must(Info("version", "")), nil, "info version\n"},
+		{"infolist with arguments", Must(Infolist("buffer", "", "irc.*")), nil, "infolist buffer 0 irc.*\n"},
+		{"nicklist of all buffers", Must(Nicklist("")), nil, "nicklist\n"},
+		{"input", Must(Input("irc.libera.#go", "hello, world")), nil, "input irc.libera.#go hello, world\n"},
+		{"completion", Must(Completion("core.weechat", -1, "/he")), nil, "completion core.weechat -1 /he\n"},
+		{"sync all", Must(Sync(nil)), nil, "sync\n"},
+		{"sync options", Must(Sync(nil, SyncBuffers, SyncUpgrade)), nil, "sync * buffers,upgrade\n"},
+		{"desync buffers", Must(Desync([]string{"irc.libera.#go", "core.weechat"}, SyncNicklist)), nil,
+			"desync irc.libera.#go,core.weechat nicklist\n"},
+		{"test", Test(), nil, "test\n"},
+		{"ping", Must(Ping("1234")), nil, "ping 1234\n"},
+		{"quit", Quit(), nil, "quit\n"},
+		{"with an id", Must(Hdata("buffer:gui_buffers(*)")).WithID("buffers"), nil, "(buffers) hdata buffer:gui_buffers(*)\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cmd.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+			if err := tt.cmd.Validate(); err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestInvalidArguments(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func() (Command, error)
+	}{
+		{"option with a newline", func() (Command, error) { return Init(map[string]string{"password": "a\nb"}) }},
+		{"option name with =", func() (Command, error) { return Init(map[string]string{"pass=word": "a"}) }},
+		{"empty hdata path", func() (Command, error) { return Hdata("") }},
+		{"hdata path with a space", func() (Command, error) { return Hdata("buffer:gui_buffers(*) x") }},
+		{"hdata key with a comma", func() (Command, error) { return Hdata("buffer:gui_buffers(*)", "a,b") }},
+		{"info name with a space", func() (Command, error) { return Info("version x", "") }},
+		{"infolist pointer with a space", func() (Command, error) { return Infolist("buffer", "0x1 2", "") }},
+		{"nicklist buffer with a space", func() (Command, error) { return Nicklist("irc.libera #go") }},
+		{"input without buffer", func() (Command, error) { return Input("", "hello") }},
+		{"empty input", func() (Command, error) { return Input("core.weechat", "") }},
+		{"input with a newline", func() (Command, error) { return Input("core.weechat", "hello\n/quit") }},
+		{"input with a carriage return", func() (Command, error) { return Input("core.weechat", "hello\r/quit") }},
+		{"completion position out of range", func() (Command, error) { return Completion("core.weechat", 4, "/he") }},
+		{"completion position below -1", func() (Command, error) { return Completion("core.weechat", -2, "/he") }},
+		{"sync buffer with a comma", func() (Command, error) { return Sync([]string{"a,b"}) }},
+		{"unknown sync option", func() (Command, error) { return Sync(nil, "lines") }},
+		{"desync buffer with a space", func() (Command, error) { return Desync([]string{"a b"}) }},
+		{"ping with a newline", func() (Command, error) { return Ping("a\r") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if cmd, err := tt.build(); !errors.Is(err, ErrInvalidArgument) {
+				t.Errorf("got %q, %v, want ErrInvalidArgument", cmd.String(), err)
+			}
+		})
+	}
+}
+
+func TestValidateID(t *testing.T) {
+	cmd := Must(Nicklist(""))
+	for _, id := range []string{"bad id", "bad)", "bad\n"} {
+		if _, err := Encode(cmd.WithID(id)); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("Encode() with the id %q error = %v, want ErrInvalidArgument", id, err)
+		}
+	}
+	if err := (Command{Name: "hdata", Args: []string{"a\nb"}}).Validate(); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Validate() of an argument with a newline error = %v, want ErrInvalidArgument", err)
+	}
+	if err := (Command{}).Validate(); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Validate() without a name error = %v, want ErrInvalidArgument", err)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	data, err := Encode(Must(Nicklist("")).WithID("nicks"), Test(), Quit())
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if want := "(nicks) nicklist\ntest\nquit\n"; string(data) != want {
+		t.Errorf("Encode() = %q, want %q", data, want)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line string
+		want Command
+	}{
+		{"hdata buffer:gui_buffers(*) number,full_name\n", Command{Name: "hdata", Args: []string{"buffer:gui_buffers(*) number,full_name"}}},
+		{"(id) info version", Command{ID: "id", Name: "info", Args: []string{"version"}}},
+		{"(id)test", Command{ID: "id", Name: "test"}},
+		{"quit\r\n", Command{Name: "quit"}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.line)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %#v, %v, want %#v", tt.line, got, err, tt.want)
+			continue
+		}
+		// Parsing the command as sent gives it back.
+		if again, err := Parse(got.String()); err != nil || !reflect.DeepEqual(again, got) {
+			t.Errorf("Parse(%q) = %#v, %v, want %#v", got.String(), again, err, got)
+		}
+	}
+
+	for _, line := range []string{"", "(id hdata", "(bad id) ping", " ping"} {
+		if cmd, err := Parse(line); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("Parse(%q) = %#v, %v, want ErrInvalidArgument", line, cmd, err)
+		}
+	}
+}
+
+func TestMustPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Must() with an error didn't panic")
+		}
+	}()
+	Must(Hdata(""))
+}
@@ -0,0 +1,129 @@
+package weechat
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms for the body of the messages sent by the relay,
+// as negotiated in the handshake.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#command_handshake
+const (
+	CompressionOff  = "off"
+	CompressionZlib = "zlib"
+	CompressionZstd = "zstd"
+)
+
+// Value of the compression flag, the byte after the length of a message,
+// for each of the algorithms.
+var compressionFlags = map[byte]string{
+	0: CompressionOff,
+	1: CompressionZlib,
+	2: CompressionZstd,
+}
+
+// Default maximum size of the body of a message once decompressed, the
+// same as the maximum size of a message on the wire, so that a small
+// compressed message can't take all the memory.
+const DefaultMaxUncompressedSize = DefaultMaxFrameSize
+
+// The zstd encoder and decoder are expensive to create and safe for
+// concurrent use with EncodeAll and DecodeAll, so they are shared.
+var (
+	zstdOnce    sync.Once
+	zstdDecoder *zstd.Decoder
+	zstdEncoder *zstd.Encoder
+	zstdErr     error
+)
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(DefaultMaxUncompressedSize))
+		if zstdErr != nil {
+			return
+		}
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+	})
+	return zstdErr
+}
+
+// Get the compression flag for an algorithm, an empty algorithm is the
+// same as "off".
+func compressionFlag(algo string) (byte, error) {
+	if algo == "" {
+		return 0, nil
+	}
+	for flag, name := range compressionFlags {
+		if name == algo {
+			return flag, nil
+		}
+	}
+	return 0, fmt.Errorf("%w %q", ErrUnknownCompression, algo)
+}
+
+// Decompress the body of a message with the given algorithm, up to max
+// bytes. Errors are returned as a *ParseError.
+func decompress(algo string, data []byte, max int) ([]byte, error) {
+	switch algo {
+	case CompressionZlib:
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, parseError(ErrDecompress, "message", data, "zlib: %v", err)
+		}
+		defer r.Close()
+		var out bytes.Buffer
+		// One byte more than the maximum to know it is too large.
+		if _, err := io.Copy(&out, io.LimitReader(r, int64(max)+1)); err != nil {
+			return nil, parseError(ErrDecompress, "message", data, "zlib: %v", err)
+		}
+		if out.Len() > max {
+			return nil, parseError(ErrUncompressedTooLarge, "message", data, "more than %v bytes", max)
+		}
+		return out.Bytes(), nil
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, fmt.Errorf("failed to create zstd decoder: %v", err)
+		}
+		// The decoder stops past DefaultMaxUncompressedSize, give or
+		// take a block, the size is checked again for a lower max.
+		out, err := zstdDecoder.DecodeAll(data, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || len(out) > max {
+			return nil, parseError(ErrUncompressedTooLarge, "message", data, "more than %v bytes", max)
+		}
+		if err != nil {
+			return nil, parseError(ErrDecompress, "message", data, "zstd: %v", err)
+		}
+		return out, nil
+	default:
+		return data, nil
+	}
+}
+
+// Compress the body of a message with the given algorithm.
+func compress(algo string, data []byte) ([]byte, error) {
+	switch algo {
+	case CompressionZlib:
+		var out bytes.Buffer
+		w := zlib.NewWriter(&out)
+		if _, err := w.Write(data); err != nil {
+			return nil, fmt.Errorf("failed to compress message body: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("failed to compress message body: %v", err)
+		}
+		return out.Bytes(), nil
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %v", err)
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	default:
+		return data, nil
+	}
+}
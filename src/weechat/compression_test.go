@@ -0,0 +1,92 @@
+package weechat
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// Build a message with the flag and a body of size bytes compressed with
+// the writer, without holding the uncompressed body in memory.
+func compressedMessage(t *testing.T, flag byte, size int64, newWriter func(io.Writer) (io.WriteCloser, error)) []byte {
+	t.Helper()
+	var body bytes.Buffer
+	w, err := newWriter(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(w, io.LimitReader(zeros{}, size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 5, 5+body.Len())
+	binary.BigEndian.PutUint32(data, uint32(5+body.Len()))
+	data[4] = flag
+	return append(data, body.Bytes()...)
+}
+
+func newZlibWriter(w io.Writer) (io.WriteCloser, error) {
+	return zlib.NewWriter(w), nil
+}
+
+func newZstdWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+func TestDecodeUncompressedTooLarge(t *testing.T) {
+	tests := []struct {
+		name      string
+		flag      byte
+		newWriter func(io.Writer) (io.WriteCloser, error)
+	}{
+		{"zlib", 1, newZlibWriter},
+		{"zstd", 2, newZstdWriter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Protocol{MaxUncompressedSize: 1000}
+			if _, err := p.Decode(compressedMessage(t, tt.flag, 1000, tt.newWriter)); err == nil {
+				t.Fatalf("Decode() of 1000 zeros error = nil, want a parse error of the body")
+			} else if errors.Is(err, ErrUncompressedTooLarge) {
+				t.Fatalf("Decode() of 1000 bytes error = %v", err)
+			}
+			data := compressedMessage(t, tt.flag, 1001, tt.newWriter)
+			_, err := p.Decode(data)
+			var perr *ParseError
+			if !errors.As(err, &perr) || !errors.Is(err, ErrUncompressedTooLarge) {
+				t.Fatalf("Decode() of %v compressed bytes error = %v, want ErrUncompressedTooLarge", len(data), err)
+			}
+			if perr.Offset != 5 {
+				t.Errorf("Offset = %v, want 5", perr.Offset)
+			}
+		})
+	}
+}
+
+func TestDecodeInvalidCompressedData(t *testing.T) {
+	for _, flag := range []byte{1, 2} {
+		data := []byte{0, 0, 0, 13, flag, 'n', 'o', 't', ' ', 'v', 'a', 'l', 'i'}
+		var p Protocol
+		_, err := p.Decode(data)
+		var perr *ParseError
+		if !errors.As(err, &perr) || !errors.Is(err, ErrDecompress) {
+			t.Errorf("Decode() with the compression flag %v error = %v, want ErrDecompress", flag, err)
+		}
+	}
+}
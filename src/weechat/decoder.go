@@ -0,0 +1,69 @@
+package weechat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Default maximum size of a single message read by a Decoder. Weechat
+// doesn't send messages anywhere close to this, but a corrupted length
+// shouldn't make us allocate gigabytes.
+const DefaultMaxFrameSize = 64 * 1024 * 1024
+
+// Returned when the length of a message is larger than MaxFrameSize.
+var ErrFrameTooLarge = errors.New("message is larger than the maximum frame size")
+
+// Decoder reads weechat messages from a stream of bytes, like a tcp
+// connection to the relay. Each message starts with a 4 byte length
+// which includes the length itself, which is used to read exactly one
+// message at a time even if it is split across multiple reads.
+type Decoder struct {
+	// Maximum size of a single message, including the length.
+	MaxFrameSize int
+
+	r     io.Reader
+	proto Protocol
+}
+
+// Create a new Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{MaxFrameSize: DefaultMaxFrameSize, r: r}
+}
+
+// Read the raw bytes of a single message, including the length. It
+// returns io.EOF only if the stream ended cleanly between two messages,
+// a stream ending in the middle of a message returns io.ErrUnexpectedEOF.
+func (d *Decoder) ReadFrame() ([]byte, error) {
+	msgLen := make([]byte, 4)
+	if _, err := io.ReadFull(d.r, msgLen); err != nil {
+		return nil, err
+	}
+	length := int(int32(binary.BigEndian.Uint32(msgLen)))
+	// The message has at least the length and the compression flag.
+	if length < 5 {
+		return nil, fmt.Errorf("invalid message length %v", length)
+	}
+	if length > d.MaxFrameSize {
+		return nil, fmt.Errorf("%w: length %v, maximum %v", ErrFrameTooLarge, length, d.MaxFrameSize)
+	}
+	frame := make([]byte, length)
+	copy(frame, msgLen)
+	if _, err := io.ReadFull(d.r, frame[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read message of length %v: %w", length, err)
+	}
+	return frame, nil
+}
+
+// Read and decode a single message.
+func (d *Decoder) Decode() (*WeechatMessage, error) {
+	frame, err := d.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	return d.proto.Decode(frame)
+}
@@ -0,0 +1,97 @@
+package weechat
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// Encode messages with the msgids back to back, like on a connection.
+func encodeStream(t *testing.T, msgids ...string) []byte {
+	t.Helper()
+	var p Protocol
+	var stream []byte
+	for _, msgid := range msgids {
+		data, err := p.Encode(&WeechatMessage{Msgid: msgid, Object: WeechatObject{OBJ_STR, msgid + " body"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, data...)
+	}
+	return stream
+}
+
+func TestDecoderSplitReads(t *testing.T) {
+	stream := encodeStream(t, "first", "second", "third")
+	d := NewDecoder(iotest.OneByteReader(bytes.NewReader(stream)))
+	for _, want := range []string{"first", "second", "third"} {
+		msg, err := d.Decode()
+		if err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		if msg.Msgid != want || msg.Object.Value != want+" body" {
+			t.Errorf("Decode() = %v %v, want %v", msg.Msgid, msg.Object.Value, want)
+		}
+	}
+	if _, err := d.ReadFrame(); err != io.EOF {
+		t.Errorf("ReadFrame() at the end error = %v, want io.EOF", err)
+	}
+}
+
+func TestDecoderTruncated(t *testing.T) {
+	stream := encodeStream(t, "first", "second")
+	first := len(encodeStream(t, "first"))
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"in the length", first + 2},
+		{"in the body", len(stream) - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(iotest.OneByteReader(bytes.NewReader(stream[:tt.size])))
+			if _, err := d.ReadFrame(); err != nil {
+				t.Fatalf("ReadFrame() of the first message error = %v", err)
+			}
+			if _, err := d.ReadFrame(); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("ReadFrame() error = %v, want io.ErrUnexpectedEOF", err)
+			}
+		})
+	}
+}
+
+func TestDecoderInvalidLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  []byte
+		wantErr error
+	}{
+		{"larger than MaxFrameSize", []byte{0, 0, 4, 1, 0}, ErrFrameTooLarge},
+		{"negative", []byte{0xff, 0xff, 0xff, 0xff, 0}, nil},
+		{"shorter than the header", []byte{0, 0, 0, 4, 0}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(bytes.NewReader(tt.header))
+			d.MaxFrameSize = 1024
+			_, err := d.ReadFrame()
+			if err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("ReadFrame() error = %v, want an invalid length", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("ReadFrame() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The maximum itself is allowed.
+	frame := encodeStream(t, "max")
+	d := NewDecoder(bytes.NewReader(frame))
+	d.MaxFrameSize = len(frame)
+	if _, err := d.ReadFrame(); err != nil {
+		t.Errorf("ReadFrame() of MaxFrameSize bytes error = %v", err)
+	}
+}
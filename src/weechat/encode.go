@@ -0,0 +1,387 @@
+package weechat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Encode a single WeechatMessage into the binary format used by the relay,
+// so that Decode(Encode(msg)) returns an equivalent message. This is the
+// format in which weechat relay sends messages to the clients and is mostly
+// useful to build fake relays for testing. The body is compressed with
+// msg.Compression, or with zlib if only msg.Compressed is set. If
+// msg.Objects is set, all of them are encoded, otherwise only msg.Object
+// is. A message without a Type and ObjType, like _upgrade, has no
+// objects at all.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#messages
+func (p *Protocol) Encode(msg *WeechatMessage) ([]byte, error) {
+	objects := msg.Objects
+	if len(objects) == 0 {
+		objType := msg.Type
+		if objType == "" {
+			objType = msg.Object.ObjType
+		}
+		if objType != "" {
+			objects = []WeechatObject{{ObjType: objType, Value: msg.Object.Value}}
+		}
+	}
+
+	var body bytes.Buffer
+	// An empty msgid is sent as a NULL string, like weechat does for
+	// commands without any id.
+	if msg.Msgid == "" {
+		p.encodeLen(&body, -1)
+	} else {
+		p.encodeString(&body, msg.Msgid)
+	}
+	for _, obj := range objects {
+		if err := p.encodeType(&body, obj.ObjType); err != nil {
+			return nil, err
+		}
+		if err := p.encodeObject(&body, obj.ObjType, obj); err != nil {
+			return nil, err
+		}
+	}
+
+	payload := body.Bytes()
+	algo := msg.Compression
+	if algo == "" && msg.Compressed {
+		algo = CompressionZlib
+	}
+	compression, err := compressionFlag(algo)
+	if err != nil {
+		return nil, err
+	}
+	if payload, err = compress(algo, payload); err != nil {
+		return nil, err
+	}
+
+	// 4 bytes for the length itself and 1 byte for the compression flag.
+	var out bytes.Buffer
+	p.encodeLen(&out, int32(len(payload)+5))
+	out.WriteByte(compression)
+	out.Write(payload)
+	return out.Bytes(), nil
+}
+
+// Encode the objects as defined in the list here, this is the inverse of
+// parseObject.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#objects
+func (p *Protocol) encodeObject(buf *bytes.Buffer, objType string, obj WeechatObject) error {
+	switch objType {
+	case OBJ_CHR:
+		return p.encodeChar(buf, obj)
+	case OBJ_INT:
+		return p.encodeInt(buf, obj)
+	case OBJ_LON, OBJ_TIM:
+		return p.encodeNumber(buf, objType, obj)
+	case OBJ_STR, OBJ_BUF:
+		return p.encodeStr(buf, objType, obj)
+	case OBJ_PTR:
+		return p.encodePointer(buf, obj)
+	case OBJ_HTB:
+		return p.encodeHashTable(buf, obj)
+	case OBJ_HDA:
+		return p.encodeHda(buf, obj)
+	case OBJ_ARR:
+		return p.encodeArray(buf, obj)
+	case OBJ_INF:
+		return p.encodeInfo(buf, obj)
+	case OBJ_INL:
+		return p.encodeInfoList(buf, obj)
+	default:
+		return fmt.Errorf("encoding of type %v is not implemented yet", objType)
+	}
+}
+
+// Error returned when the Value of an object is not of the Go type that
+// is expected for its object type.
+func encodeTypeError(objType string, value interface{}) error {
+	return fmt.Errorf("can't encode value %v of Go type %T as %v", value, value, objType)
+}
+
+// Encode a 3 letter object type.
+func (p *Protocol) encodeType(buf *bytes.Buffer, objType string) error {
+	if len(objType) != 3 {
+		return fmt.Errorf("invalid object type %q, must be 3 characters", objType)
+	}
+	buf.WriteString(objType)
+	return nil
+}
+
+// Encode a 4 byte signed integer, used for lengths and counts.
+func (p *Protocol) encodeLen(buf *bytes.Buffer, length int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(length))
+	buf.Write(b[:])
+}
+
+// Encode a string with its 4 byte length.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_string
+func (p *Protocol) encodeString(buf *bytes.Buffer, value string) {
+	p.encodeLen(buf, int32(len(value)))
+	buf.WriteString(value)
+}
+
+// Encode a single character of length 1 byte.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_char
+func (p *Protocol) encodeChar(buf *bytes.Buffer, obj WeechatObject) error {
+	switch v := obj.Value.(type) {
+	case string:
+		if len(v) != 1 {
+			return fmt.Errorf("can't encode string %q of length %v as %v", v, len(v), OBJ_CHR)
+		}
+		buf.WriteByte(v[0])
+	case byte:
+		buf.WriteByte(v)
+	default:
+		return encodeTypeError(OBJ_CHR, obj.Value)
+	}
+	return nil
+}
+
+// Encode 4 byte signed Integer.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_integer
+func (p *Protocol) encodeInt(buf *bytes.Buffer, obj WeechatObject) error {
+	switch v := obj.Value.(type) {
+	case int32:
+		p.encodeLen(buf, v)
+	case int:
+		p.encodeLen(buf, int32(v))
+	default:
+		return encodeTypeError(OBJ_INT, obj.Value)
+	}
+	return nil
+}
+
+// Encode long integer and time, which are both sent as a string with a 1
+// byte length in the start.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_long_integer
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_time
+func (p *Protocol) encodeNumber(buf *bytes.Buffer, objType string, obj WeechatObject) error {
+	var value string
+	switch v := obj.Value.(type) {
+	case string:
+		value = v
+	case int64:
+		value = fmt.Sprintf("%d", v)
+	case time.Time:
+		value = fmt.Sprintf("%d", v.Unix())
+	default:
+		return encodeTypeError(objType, obj.Value)
+	}
+	return p.encodeSmallString(buf, objType, value)
+}
+
+// Encode a string or a buffer. Buffers can be either a string or []byte.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_string
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_buffer
+func (p *Protocol) encodeStr(buf *bytes.Buffer, objType string, obj WeechatObject) error {
+	switch v := obj.Value.(type) {
+	case nil:
+		// NULL string or buffer.
+		p.encodeLen(buf, -1)
+	case string:
+		p.encodeString(buf, v)
+	case []byte:
+		if objType != OBJ_BUF {
+			return encodeTypeError(objType, obj.Value)
+		}
+		p.encodeLen(buf, int32(len(v)))
+		buf.Write(v)
+	default:
+		return encodeTypeError(objType, obj.Value)
+	}
+	return nil
+}
+
+// Encode a single pointer, single byte length and then the pointer in
+// hexadecimal without the "0x" prefix. A nil Value is a NULL pointer.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_pointer
+func (p *Protocol) encodePointer(buf *bytes.Buffer, obj WeechatObject) error {
+	if obj.Value == nil {
+		return p.encodeSmallString(buf, OBJ_PTR, "0")
+	}
+	value, ok := obj.Value.(string)
+	if !ok {
+		return encodeTypeError(OBJ_PTR, obj.Value)
+	}
+	return p.encodeSmallString(buf, OBJ_PTR, strings.TrimPrefix(value, "0x"))
+}
+
+// Encode a string with a single byte length, used for pointers, long integers
+// and time. Not an actual datatype.
+func (p *Protocol) encodeSmallString(buf *bytes.Buffer, objType string, value string) error {
+	if len(value) > 255 {
+		return fmt.Errorf("can't encode %q as %v, longer than 255 bytes", value, objType)
+	}
+	buf.WriteByte(byte(len(value)))
+	buf.WriteString(value)
+	return nil
+}
+
+// Encode a hash table. The key and value types are picked from the first
+// item in the table and default to strings for an empty table.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_hashtable
+func (p *Protocol) encodeHashTable(buf *bytes.Buffer, obj WeechatObject) error {
+	hashtable, ok := obj.Value.(map[WeechatObject]WeechatObject)
+	if !ok {
+		return encodeTypeError(OBJ_HTB, obj.Value)
+	}
+	keyType, valueType := OBJ_STR, OBJ_STR
+	for key, value := range hashtable {
+		keyType, valueType = key.ObjType, value.ObjType
+		break
+	}
+	if err := p.encodeType(buf, keyType); err != nil {
+		return err
+	}
+	if err := p.encodeType(buf, valueType); err != nil {
+		return err
+	}
+	p.encodeLen(buf, int32(len(hashtable)))
+	for key, value := range hashtable {
+		if err := p.encodeObject(buf, keyType, key); err != nil {
+			return err
+		}
+		if err := p.encodeObject(buf, valueType, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encode an array. The type of the objects is picked from the first item
+// and defaults to strings for an empty array.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_array
+func (p *Protocol) encodeArray(buf *bytes.Buffer, obj WeechatObject) error {
+	arr, ok := obj.Value.([]WeechatObject)
+	if !ok {
+		return encodeTypeError(OBJ_ARR, obj.Value)
+	}
+	objType := OBJ_STR
+	if len(arr) > 0 {
+		objType = arr[0].ObjType
+	}
+	if err := p.encodeType(buf, objType); err != nil {
+		return err
+	}
+	p.encodeLen(buf, int32(len(arr)))
+	for _, value := range arr {
+		if err := p.encodeObject(buf, objType, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encode Info, which is a single key-value pair of type string.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_info
+func (p *Protocol) encodeInfo(buf *bytes.Buffer, obj WeechatObject) error {
+	info, ok := obj.Value.(map[string]string)
+	if !ok || len(info) != 1 {
+		return encodeTypeError(OBJ_INF, obj.Value)
+	}
+	for key, value := range info {
+		p.encodeString(buf, key)
+		p.encodeString(buf, value)
+	}
+	return nil
+}
+
+// Encode Infolist, a name and then a list of items where each item is a
+// list of name, type and value of its variables.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_infolist
+func (p *Protocol) encodeInfoList(buf *bytes.Buffer, obj WeechatObject) error {
+	infolist, ok := obj.Value.(WeechatInfolistValue)
+	if !ok {
+		return encodeTypeError(OBJ_INL, obj.Value)
+	}
+	p.encodeString(buf, infolist.Name)
+	p.encodeLen(buf, int32(len(infolist.Items)))
+	for _, item := range infolist.Items {
+		p.encodeLen(buf, int32(len(item)))
+		for _, key := range sortedKeys(item) {
+			value := item[key]
+			p.encodeString(buf, key)
+			if err := p.encodeType(buf, value.ObjType); err != nil {
+				return err
+			}
+			if err := p.encodeObject(buf, value.ObjType, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Encode hdata. If the Keys of the hdata are not set, they are built from
+// the first item using the ObjType of each value, sorted by name. Pointers
+// for each item are read from the "__path" key.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_hdata
+func (p *Protocol) encodeHda(buf *bytes.Buffer, obj WeechatObject) error {
+	hda, ok := obj.Value.(WeechatHdaValue)
+	if !ok {
+		return encodeTypeError(OBJ_HDA, obj.Value)
+	}
+	keys := hda.Keys
+	if keys == "" && len(hda.Value) > 0 {
+		var pairs []string
+		for _, name := range sortedKeys(hda.Value[0]) {
+			if name == "__path" {
+				continue
+			}
+			pairs = append(pairs, name+":"+hda.Value[0][name].ObjType)
+		}
+		keys = strings.Join(pairs, ",")
+	}
+	p.encodeString(buf, hda.Hpath)
+	p.encodeString(buf, keys)
+	p.encodeLen(buf, int32(len(hda.Value)))
+
+	pointerCount := len(strings.Split(hda.Hpath, "/"))
+	for _, item := range hda.Value {
+		pointers, _ := item["__path"].Value.([]string)
+		if len(pointers) != pointerCount {
+			return fmt.Errorf("hdata item has %v pointers in __path, expected %v for hpath %v",
+				len(pointers), pointerCount, hda.Hpath)
+		}
+		for _, pointer := range pointers {
+			if err := p.encodePointer(buf, WeechatObject{OBJ_PTR, pointer}); err != nil {
+				return err
+			}
+		}
+		if keys == "" {
+			continue
+		}
+		for _, pair := range strings.Split(keys, ",") {
+			s := strings.Split(pair, ":")
+			if len(s) != 2 {
+				return fmt.Errorf("invalid hdata key %q, expected name:type", pair)
+			}
+			value, ok := item[s[0]]
+			if !ok {
+				return fmt.Errorf("hdata item is missing key %v", s[0])
+			}
+			if err := p.encodeObject(buf, s[1], value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Return the keys of a WeechatDict in sorted order, so that the encoded
+// output is stable.
+func sortedKeys(dict WeechatDict) []string {
+	keys := make([]string, 0, len(dict))
+	for key := range dict {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,167 @@
+package weechat
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	hda := WeechatHdaValue{
+		Hpath: "buffer/lines/line/line_data",
+		Keys:  "date:tim,displayed:chr,notify_level:chr,prefix:str,message:str,tags_array:arr",
+		Value: []WeechatDict{{
+			"__path":       {"__path", []string{"1000", "2000", "3000", "4000"}},
+			"date":         {OBJ_TIM, "1634515200"},
+			"displayed":    {OBJ_CHR, "\x01"},
+			"notify_level": {OBJ_CHR, "\xff"},
+			"prefix":       {OBJ_STR, nil},
+			"message":      {OBJ_STR, "hello"},
+			"tags_array":   {OBJ_ARR, []WeechatObject{{OBJ_STR, "irc_privmsg"}, {OBJ_STR, "notify_none"}}},
+		}},
+	}
+	inl := WeechatInfolistValue{
+		Name: "buffer",
+		Items: []WeechatDict{
+			{"name": {OBJ_STR, "weechat"}, "pointer": {OBJ_PTR, "55d0a0001000"}, "number": {OBJ_INT, int32(1)}},
+			{"name": {OBJ_STR, ""}, "pointer": {OBJ_PTR, nil}, "type": {OBJ_CHR, "\x80"}},
+		},
+	}
+	tests := []struct {
+		name    string
+		objects []WeechatObject
+	}{
+		{"chr", []WeechatObject{{OBJ_CHR, "A"}}},
+		{"high byte chr", []WeechatObject{{OBJ_CHR, "\xff"}}},
+		{"int", []WeechatObject{{OBJ_INT, int32(-123456)}}},
+		{"lon", []WeechatObject{{OBJ_LON, "-1234567890123"}}},
+		{"tim", []WeechatObject{{OBJ_TIM, "1634515200"}}},
+		{"str", []WeechatObject{{OBJ_STR, "hello, world"}}},
+		{"empty str", []WeechatObject{{OBJ_STR, ""}}},
+		{"NULL str", []WeechatObject{{OBJ_STR, nil}}},
+		{"buf", []WeechatObject{{OBJ_BUF, []byte{0, 1, 0xff}}}},
+		{"empty buf", []WeechatObject{{OBJ_BUF, []byte{}}}},
+		{"NULL buf", []WeechatObject{{OBJ_BUF, nil}}},
+		{"ptr", []WeechatObject{{OBJ_PTR, "55d0a0001000"}}},
+		{"NULL ptr", []WeechatObject{{OBJ_PTR, nil}}},
+		{"htb", []WeechatObject{{OBJ_HTB, map[WeechatObject]WeechatObject{
+			{OBJ_STR, "plugin"}: {OBJ_STR, "irc"},
+			{OBJ_STR, "nick"}:   {OBJ_STR, nil},
+		}}}},
+		{"hda", []WeechatObject{{OBJ_HDA, hda}}},
+		{"empty hda", []WeechatObject{{OBJ_HDA, WeechatHdaValue{Hpath: "buffer", Keys: "number:int", Value: []WeechatDict{}}}}},
+		{"inf", []WeechatObject{{OBJ_INF, map[string]string{"version": "3.5"}}}},
+		{"inl", []WeechatObject{{OBJ_INL, inl}}},
+		{"arr", []WeechatObject{{OBJ_ARR, []WeechatObject{{OBJ_INT, int32(1)}, {OBJ_INT, int32(-1)}}}}},
+		{"multiple objects", []WeechatObject{
+			{OBJ_STR, "first"},
+			{OBJ_INT, int32(2)},
+			{OBJ_CHR, "\x80"},
+			{OBJ_HDA, hda},
+			{OBJ_PTR, nil},
+		}},
+	}
+	for _, tt := range tests {
+		for _, compression := range []string{CompressionOff, CompressionZlib, CompressionZstd} {
+			t.Run(tt.name+"/"+compression, func(t *testing.T) {
+				var p Protocol
+				data, err := p.Encode(&WeechatMessage{Msgid: "test", Compression: compression, Objects: tt.objects})
+				if err != nil {
+					t.Fatalf("Encode() error = %v", err)
+				}
+				msg, err := p.Decode(data)
+				if err != nil {
+					t.Fatalf("Decode() error = %v", err)
+				}
+				if msg.Msgid != "test" || msg.Compression != compression || msg.Size != len(data) {
+					t.Errorf("Decode() = msgid %q, compression %v, size %v", msg.Msgid, msg.Compression, msg.Size)
+				}
+				if compression == CompressionOff && msg.SizeUncompressed != len(data)-5 {
+					t.Errorf("SizeUncompressed = %v, want %v", msg.SizeUncompressed, len(data)-5)
+				}
+				if msg.Type != tt.objects[0].ObjType || !reflect.DeepEqual(msg.Object, tt.objects[0]) {
+					t.Errorf("Decode() first object = %v %#v, want %#v", msg.Type, msg.Object, tt.objects[0])
+				}
+				if !reflect.DeepEqual(msg.Objects, tt.objects) {
+					t.Errorf("Decode() objects = %#v, want %#v", msg.Objects, tt.objects)
+				}
+			})
+		}
+	}
+}
+
+func TestEncodeNoObjects(t *testing.T) {
+	var p Protocol
+	data, err := p.Encode(&WeechatMessage{Msgid: "_upgrade"})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	msg, err := p.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if msg.Msgid != "_upgrade" || msg.Type != "" || len(msg.Objects) != 0 {
+		t.Errorf("Decode() = %+v, want _upgrade without objects", msg)
+	}
+}
+
+func TestEncodeBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		obj  WeechatObject
+		want []byte
+	}{
+		{"arr", WeechatObject{OBJ_ARR, []WeechatObject{{OBJ_INT, int32(1)}, {OBJ_INT, int32(-1)}}},
+			[]byte("arrint\x00\x00\x00\x02\x00\x00\x00\x01\xff\xff\xff\xff")},
+		{"inl", WeechatObject{OBJ_INL, WeechatInfolistValue{
+			Name:  "buffer",
+			Items: []WeechatDict{{"name": {OBJ_STR, "weechat"}, "pointer": {OBJ_PTR, "0x1a"}}},
+		}}, []byte("inl\x00\x00\x00\x06buffer\x00\x00\x00\x01\x00\x00\x00\x02" +
+			"\x00\x00\x00\x04namestr\x00\x00\x00\x07weechat\x00\x00\x00\x07pointerptr\x021a")},
+		{"hda", WeechatObject{OBJ_HDA, WeechatHdaValue{
+			Hpath: "buffer",
+			Keys:  "number:int",
+			Value: []WeechatDict{{"__path": {"__path", []string{"1a"}}, "number": {OBJ_INT, int32(1)}}},
+		}}, []byte("hda\x00\x00\x00\x06buffer\x00\x00\x00\x0anumber:int\x00\x00\x00\x01\x021a\x00\x00\x00\x01")},
+		{"NULL ptr", WeechatObject{OBJ_PTR, nil}, []byte("ptr\x010")},
+		{"NULL str", WeechatObject{OBJ_STR, nil}, []byte("str\xff\xff\xff\xff")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Protocol
+			data, err := p.Encode(&WeechatMessage{Object: tt.obj})
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			// Length, compression flag and a NULL msgid before the object.
+			want := append([]byte{0, 0, 0, byte(len(tt.want) + 9), 0, 0xff, 0xff, 0xff, 0xff}, tt.want...)
+			if !bytes.Equal(data, want) {
+				t.Errorf("Encode() = %q, want %q", data, want)
+			}
+		})
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		obj  WeechatObject
+	}{
+		{"chr of 2 bytes", WeechatObject{OBJ_CHR, "ab"}},
+		{"int as string", WeechatObject{OBJ_INT, "1"}},
+		{"str as []byte", WeechatObject{OBJ_STR, []byte("x")}},
+		{"unknown type", WeechatObject{"xyz", "x"}},
+		{"hda without __path", WeechatObject{OBJ_HDA, WeechatHdaValue{
+			Hpath: "buffer", Keys: "number:int",
+			Value: []WeechatDict{{"number": {OBJ_INT, int32(1)}}},
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Protocol
+			if _, err := p.Encode(&WeechatMessage{Object: tt.obj}); err == nil {
+				t.Errorf("Encode(%#v) error = nil, want an error", tt.obj)
+			}
+		})
+	}
+}
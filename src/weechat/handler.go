@@ -2,8 +2,6 @@ package weechat
 
 import (
 	"fmt"
-	"strconv"
-	"time"
 )
 
 // Interface for handler that handles various events.
@@ -12,8 +10,43 @@ type HandleWeechatMessage interface {
 
 	HandleNickList(string, []*WeechatNick)
 
+	// Called with the changes to the nicklist of a single buffer.
+	HandleNickListDiff(string, []*WeechatNickDiff)
+
 	HandleLineAdded(*WeechatLine)
 
+	HandleHotlist([]*WeechatHotlist)
+
+	HandleBufferClosing(*WeechatBuffer)
+
+	HandleBufferRenamed(*WeechatBuffer)
+
+	HandleBufferTitleChanged(*WeechatBuffer)
+
+	HandleBufferMoved(*WeechatBuffer)
+
+	// Called for both _buffer_merged and _buffer_unmerged.
+	HandleBufferMerged(buf *WeechatBuffer, merged bool)
+
+	// Called for both _buffer_hidden and _buffer_unhidden.
+	HandleBufferHidden(buf *WeechatBuffer, hidden bool)
+
+	HandleBufferTypeChanged(*WeechatBuffer)
+
+	// Called when a local variable is added, changed or removed, with
+	// all the local variables of the buffer.
+	HandleBufferLocalvars(*WeechatBuffer)
+
+	HandleBufferCleared(*WeechatBuffer)
+
+	// Called when Weechat starts to /upgrade. The pointers of all the
+	// buffers change during the upgrade.
+	HandleUpgrade()
+
+	// Called when the upgrade is done, the buffers and their lines have to
+	// be fetched again with their new pointers.
+	HandleUpgradeEnded()
+
 	Default(*WeechatMessage)
 
 	Debug(string)
@@ -32,56 +65,86 @@ func HandleMessage(msg *WeechatMessage, handler HandleWeechatMessage) error {
 	switch msg.Msgid {
 	case "listbuffers", "_buffer_opened":
 		// parse out the list of buffers which are Hda objects.
-		bufffers := msg.Object.Value.(WeechatHdaValue)
-		buflist := make(map[string]*WeechatBuffer, len(bufffers.Value))
-
-		for _, each := range bufffers.Value {
-			buf := &WeechatBuffer{
-				ShortName: each["short_name"].Value.(string),
-				FullName:  each["full_name"].Value.(string),
-				Title:     each["title"].Value.(string),
-				Number:    each["number"].Value.(int32),
-				LocalVars: each["local_variables"].Value.(map[WeechatObject]WeechatObject),
-				Lines:     make([]*WeechatLine, 0),
-				// this is essentially a list of strings, pointers,
-				// the first pointer of which is the buffer' pointer.
-				Path: each["__path"].Value.([]string)[1],
-			}
+		var buffers []*WeechatBuffer
+		if err := unmarshalMessage(msg, &buffers); err != nil {
+			return err
+		}
+		buflist := make(map[string]*WeechatBuffer, len(buffers))
+		for _, buf := range buffers {
+			buf.Lines = make([]*WeechatLine, 0)
 			buflist[buf.Path] = buf
 		}
 
 		handler.HandleListBuffers(buflist)
 
+	case "_buffer_closing", "_buffer_renamed", "_buffer_title_changed",
+		"_buffer_moved", "_buffer_merged", "_buffer_unmerged",
+		"_buffer_hidden", "_buffer_unhidden", "_buffer_type_changed",
+		"_buffer_localvar_added", "_buffer_localvar_changed",
+		"_buffer_localvar_removed", "_buffer_cleared":
+		// All of them have the buffer with only the changed keys.
+		var buffers []*WeechatBuffer
+		if err := unmarshalMessage(msg, &buffers); err != nil {
+			return err
+		}
+		for _, buf := range buffers {
+			handleBufferEvent(msg.Msgid, buf, handler)
+		}
 	case "_buffer_line_added":
-		for _, each := range msg.Object.Value.(WeechatHdaValue).Value {
-			addLine(handler, each)
+		var lines []*WeechatLine
+		if err := unmarshalMessage(msg, &lines); err != nil {
+			return err
+		}
+		for _, line := range lines {
+			handler.HandleLineAdded(line)
 		}
 	case "listlines":
-		lines := msg.Object.Value.(WeechatHdaValue).Value
+		var lines []*WeechatLine
+		if err := unmarshalMessage(msg, &lines); err != nil {
+			return err
+		}
+		// Lines are sent starting from the last one.
 		for i := len(lines) - 1; i >= 0; i-- {
-			addLine(handler, lines[i])
+			handler.HandleLineAdded(lines[i])
 		}
 	case "nicklist", "_nicklist":
 		// handle list of nicks.
 		var nicks []*WeechatNick
-		nickValues := msg.Object.Value.(WeechatHdaValue).Value
+		if err := unmarshalMessage(msg, &nicks); err != nil {
+			return err
+		}
 		var buffer = "default"
-		for _, val := range nickValues {
-
-			item := &WeechatNick{
-				Name:        val["name"].as_string(),
-				Color:       val["color"].as_string(),
-				Level:       val["level"].as_int(),
-				Prefix:      val["prefix"].as_string(),
-				PrefixColor: val["prefix_color"].as_string(),
-				Group:       val["group"].as_bool(),
-				Visible:     val["visible"].as_bool(),
-			}
-
-			nicks = append(nicks, item)
-			buffer = val["__path"].Value.([]string)[2]
+		if len(nicks) > 0 {
+			buffer = nicks[len(nicks)-1].Buffer
 		}
 		handler.HandleNickList(buffer, nicks)
+	case "hotlist":
+		var hotlist []*WeechatHotlist
+		if err := unmarshalMessage(msg, &hotlist); err != nil {
+			return err
+		}
+		handler.HandleHotlist(hotlist)
+	case "_nicklist_diff":
+		var diff []*WeechatNickDiff
+		if err := unmarshalMessage(msg, &diff); err != nil {
+			return err
+		}
+		// Split the changes by buffer, keeping their order.
+		var buffers []string
+		byBuffer := make(map[string][]*WeechatNickDiff)
+		for _, d := range diff {
+			if _, ok := byBuffer[d.Buffer]; !ok {
+				buffers = append(buffers, d.Buffer)
+			}
+			byBuffer[d.Buffer] = append(byBuffer[d.Buffer], d)
+		}
+		for _, buffer := range buffers {
+			handler.HandleNickListDiff(buffer, byBuffer[buffer])
+		}
+	case "_upgrade":
+		handler.HandleUpgrade()
+	case "_upgrade_ended":
+		handler.HandleUpgradeEnded()
 	case "error":
 		handler.Default(msg)
 	default:
@@ -90,19 +153,38 @@ func HandleMessage(msg *WeechatMessage, handler HandleWeechatMessage) error {
 	return nil
 }
 
-func addLine(handler HandleWeechatMessage, each map[string]WeechatObject) error {
-	secs, _ := strconv.ParseInt(each["date"].as_string(), 10, 64)
-	utime := time.Unix(secs, 0)
-	line := WeechatLine{
-		Buffer:  each["buffer"].as_string(),
-		Message: each["message"].as_string(),
-		Date:    utime,
-		// DatePrinted: each["date_printed"].as_string(),
-		Displayed: each["displayed"].as_bool(),
-		// NotifyLevel: each["notify_level"].as_int(),
-		Highlight: each["highlight"].as_bool(),
-		Prefix:    each["prefix"].as_string(),
+// Call the handler method for a single buffer event.
+func handleBufferEvent(msgid string, buf *WeechatBuffer, handler HandleWeechatMessage) {
+	switch msgid {
+	case "_buffer_closing":
+		handler.HandleBufferClosing(buf)
+	case "_buffer_renamed":
+		handler.HandleBufferRenamed(buf)
+	case "_buffer_title_changed":
+		handler.HandleBufferTitleChanged(buf)
+	case "_buffer_moved":
+		handler.HandleBufferMoved(buf)
+	case "_buffer_merged", "_buffer_unmerged":
+		handler.HandleBufferMerged(buf, msgid == "_buffer_merged")
+	case "_buffer_hidden", "_buffer_unhidden":
+		handler.HandleBufferHidden(buf, msgid == "_buffer_hidden")
+	case "_buffer_type_changed":
+		handler.HandleBufferTypeChanged(buf)
+	case "_buffer_localvar_added", "_buffer_localvar_changed", "_buffer_localvar_removed":
+		handler.HandleBufferLocalvars(buf)
+	case "_buffer_cleared":
+		handler.HandleBufferCleared(buf)
+	}
+}
+
+// Unmarshal the hdata object of a message into v.
+func unmarshalMessage(msg *WeechatMessage, v interface{}) error {
+	hda, err := msg.Object.Hdata()
+	if err == nil {
+		err = UnmarshalHdata(hda, v)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to handle %v: %w", msg.Msgid, err)
 	}
-	handler.HandleLineAdded(&line)
 	return nil
 }
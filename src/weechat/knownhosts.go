@@ -0,0 +1,167 @@
+package weechat
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Returned when the certificate of a relay doesn't match the fingerprint
+// stored for it in the KnownHosts.
+var ErrFingerprintMismatch = errors.New("certificate fingerprint of the relay changed")
+
+// SHA-256 fingerprint of a certificate, in lowercase hex like the
+// tls_fingerprint options of weechat.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// KnownHosts pins the certificates of relays by their fingerprint. The
+// ones that aren't signed by a trusted CA are trusted on first use, like
+// ssh does. The file has a line for each relay with its address
+// (host:port) and the fingerprint of its certificate, separated by a
+// space. Lines starting with a # are comments.
+type KnownHosts struct {
+	// Path of the file, it is created along with its directory when the
+	// first relay is added.
+	Path string
+	// Called with the fingerprint the first time a relay is seen, before
+	// it is stored, so it can be shown to the user. Returning an error
+	// refuses the certificate. If nil, all new relays are trusted.
+	OnNew func(address string, fingerprint string) error
+
+	mu sync.Mutex
+}
+
+// Get the fingerprint stored for the address, "" if there is none.
+func (k *KnownHosts) Lookup(address string) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.lookup(address)
+}
+
+func (k *KnownHosts) lookup(address string) (string, error) {
+	file, err := os.Open(k.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == address {
+			return strings.ToLower(fields[1]), nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// Store the fingerprint for the address.
+func (k *KnownHosts) Add(address string, fingerprint string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.add(address, fingerprint)
+}
+
+func (k *KnownHosts) add(address string, fingerprint string) error {
+	if err := os.MkdirAll(filepath.Dir(k.Path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(k.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(file, "%v %v\n", address, fingerprint); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Check the certificate of the relay at address against the stored
+// fingerprint, storing it if the relay is new.
+func (k *KnownHosts) Verify(address string, cert *x509.Certificate) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	known, err := k.check(address, cert)
+	if err != nil || known {
+		return err
+	}
+	fingerprint := Fingerprint(cert)
+	if k.OnNew != nil {
+		if err := k.OnNew(address, fingerprint); err != nil {
+			return err
+		}
+	}
+	if err := k.add(address, fingerprint); err != nil {
+		return fmt.Errorf("failed to store the fingerprint of %v: %w", address, err)
+	}
+	return nil
+}
+
+// Check the certificate against the fingerprint stored for the address,
+// known is false when there is none.
+func (k *KnownHosts) check(address string, cert *x509.Certificate) (known bool, err error) {
+	stored, err := k.lookup(address)
+	if err != nil {
+		return false, fmt.Errorf("failed to read the known hosts: %w", err)
+	}
+	if stored == "" {
+		return false, nil
+	}
+	if fingerprint := Fingerprint(cert); fingerprint != stored {
+		return true, fmt.Errorf("%w: %v has the SHA-256 fingerprint %v instead of %v stored in %v, "+
+			"either someone is intercepting the connection or the certificate was renewed "+
+			"and the line of %v must be removed from the file",
+			ErrFingerprintMismatch, address, fingerprint, stored, k.Path, address)
+	}
+	return true, nil
+}
+
+// Check the certificate of the connection, for tls.Config.VerifyConnection.
+// A certificate signed by an unknown authority, like a self signed one,
+// is pinned on first use. One signed by a trusted CA is verified as
+// usual, host name included, and must also match the fingerprint stored
+// for the address if there is one, but it isn't stored.
+func (k *KnownHosts) verifyConnection(address string, serverName string, roots *x509.CertPool) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		certs := state.PeerCertificates
+		if len(certs) == 0 {
+			return errors.New("the relay sent no certificate")
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		var unknown x509.UnknownAuthorityError
+		if errors.As(err, &unknown) {
+			return k.Verify(address, certs[0])
+		}
+		if err != nil {
+			return err
+		}
+		if err := certs[0].VerifyHostname(serverName); err != nil {
+			return err
+		}
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		_, err = k.check(address, certs[0])
+		return err
+	}
+}
@@ -1,42 +1,235 @@
 package weechat
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/maxking/weeclient/src/color"
+	"github.com/maxking/weeclient/src/weechat/commands"
 )
 
 // Core weechat object. This represents a parsed Core object type.
-// It doesn't currently capture all the data in a single object
-// and kinda uses only a single untyped Value fields. In future,
-// try to figure out something better here that alows optional
-// fields for specific objects.
+// It uses a single untyped Value field, whose Go type depends on
+// ObjType, use the typed accessors below to get the value out of it
+// safely:
+//
+//	chr -> string of length 1
+//	int -> int32
+//	lon, tim -> string, the number as sent by weechat
+//	str -> string, nil if the string is NULL
+//	buf -> []byte, nil if the buffer is NULL
+//	ptr -> string in hex without 0x, nil if the pointer is NULL
+//	htb -> map[WeechatObject]WeechatObject
+//	hda -> WeechatHdaValue
+//	inf -> map[string]string
+//	inl -> WeechatInfolistValue
+//	arr -> []WeechatObject
 type WeechatObject struct {
 	ObjType string
 	Value   interface{}
 }
 
-// Coerce the value to string. Only handles string types for now.
-func (o WeechatObject) as_string() string {
-	return o.Value.(string)
+var (
+	// Returned by the accessors when the value is a NULL string, buffer
+	// or pointer.
+	ErrNull = errors.New("value is null")
+	// Returned by the accessors when the object is not of the type that
+	// was asked for.
+	ErrWrongType = errors.New("wrong object type")
+)
+
+// Error for an accessor called on the wrong type of object.
+func (o WeechatObject) wrongType(want ...string) error {
+	return fmt.Errorf("%w: expected %v, got %v", ErrWrongType, strings.Join(want, " or "), o.ObjType)
+}
+
+// Check the object is of one of the types and not null.
+func (o WeechatObject) check(types ...string) error {
+	for _, objType := range types {
+		if o.ObjType == objType {
+			if o.Value == nil {
+				return ErrNull
+			}
+			return nil
+		}
+	}
+	return o.wrongType(types...)
+}
+
+// Is the value a NULL string, buffer or pointer?
+func (o WeechatObject) IsNull() bool {
+	return o.Value == nil
+}
+
+// Value of a string or a buffer as a string. Returns ErrNull for a NULL
+// string, which is different from an empty string.
+func (o WeechatObject) String() (string, error) {
+	if err := o.check(OBJ_STR, OBJ_BUF); err != nil {
+		return "", err
+	}
+	switch v := o.Value.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	}
+	return "", o.wrongType(OBJ_STR, OBJ_BUF)
+}
+
+// Value of a buffer. Returns ErrNull for a NULL buffer.
+func (o WeechatObject) Bytes() ([]byte, error) {
+	if err := o.check(OBJ_BUF); err != nil {
+		return nil, err
+	}
+	v, ok := o.Value.([]byte)
+	if !ok {
+		return nil, o.wrongType(OBJ_BUF)
+	}
+	return v, nil
+}
+
+// Value of a char, as the byte sent on the wire. Weechat uses signed
+// chars for numbers, like -1 for the notify_level "none", so int8(c) is
+// the number.
+func (o WeechatObject) Char() (byte, error) {
+	if err := o.check(OBJ_CHR); err != nil {
+		return 0, err
+	}
+	v, ok := o.Value.(string)
+	if !ok || len(v) != 1 {
+		return 0, o.wrongType(OBJ_CHR)
+	}
+	return v[0], nil
+}
+
+// Value of a char used as a boolean, like the "displayed" and "highlight"
+// of lines. Weechat sends them as 0 or 1.
+func (o WeechatObject) Bool() (bool, error) {
+	c, err := o.Char()
+	if err != nil {
+		return false, err
+	}
+	return c != 0 && c != '0', nil
+}
+
+// Value of an integer.
+func (o WeechatObject) Int() (int32, error) {
+	if err := o.check(OBJ_INT); err != nil {
+		return 0, err
+	}
+	v, ok := o.Value.(int32)
+	if !ok {
+		return 0, o.wrongType(OBJ_INT)
+	}
+	return v, nil
+}
+
+// Value of a long integer.
+func (o WeechatObject) Long() (int64, error) {
+	if err := o.check(OBJ_LON); err != nil {
+		return 0, err
+	}
+	v, ok := o.Value.(string)
+	if !ok {
+		return 0, o.wrongType(OBJ_LON)
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// Value of a time, which weechat sends as seconds since epoch.
+func (o WeechatObject) Time() (time.Time, error) {
+	if err := o.check(OBJ_TIM); err != nil {
+		return time.Time{}, err
+	}
+	v, ok := o.Value.(string)
+	if !ok {
+		return time.Time{}, o.wrongType(OBJ_TIM)
+	}
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(secs, 0), nil
+}
+
+// Value of a pointer, in hex without the 0x prefix. Returns ErrNull for a
+// NULL pointer.
+func (o WeechatObject) Pointer() (string, error) {
+	if err := o.check(OBJ_PTR); err != nil {
+		return "", err
+	}
+	v, ok := o.Value.(string)
+	if !ok {
+		return "", o.wrongType(OBJ_PTR)
+	}
+	return v, nil
+}
+
+// Value of a hashtable.
+func (o WeechatObject) Hashtable() (map[WeechatObject]WeechatObject, error) {
+	if err := o.check(OBJ_HTB); err != nil {
+		return nil, err
+	}
+	v, ok := o.Value.(map[WeechatObject]WeechatObject)
+	if !ok {
+		return nil, o.wrongType(OBJ_HTB)
+	}
+	return v, nil
+}
 
-	// switch o.ObjType {
-	// case OBJ_STR:
-	// 	return o.Value.(string)
-	// default:
-	// 	return "Invalid string coercion of Weechat obj"
-	// }
+// Value of an array.
+func (o WeechatObject) Array() ([]WeechatObject, error) {
+	if err := o.check(OBJ_ARR); err != nil {
+		return nil, err
+	}
+	v, ok := o.Value.([]WeechatObject)
+	if !ok {
+		return nil, o.wrongType(OBJ_ARR)
+	}
+	return v, nil
 }
 
-func (o WeechatObject) as_int() int32 {
-	return o.Value.(int32)
+// Value of a hdata.
+func (o WeechatObject) Hdata() (WeechatHdaValue, error) {
+	if err := o.check(OBJ_HDA); err != nil {
+		return WeechatHdaValue{}, err
+	}
+	v, ok := o.Value.(WeechatHdaValue)
+	if !ok {
+		return WeechatHdaValue{}, o.wrongType(OBJ_HDA)
+	}
+	return v, nil
 }
 
-func (o WeechatObject) as_bool() bool {
-	return o.Value == "1"
+// Name and value of an info.
+func (o WeechatObject) Info() (string, string, error) {
+	if err := o.check(OBJ_INF); err != nil {
+		return "", "", err
+	}
+	v, ok := o.Value.(map[string]string)
+	if !ok || len(v) != 1 {
+		return "", "", o.wrongType(OBJ_INF)
+	}
+	for name, value := range v {
+		return name, value, nil
+	}
+	return "", "", nil
+}
+
+// Value of an infolist.
+func (o WeechatObject) Infolist() (WeechatInfolistValue, error) {
+	if err := o.check(OBJ_INL); err != nil {
+		return WeechatInfolistValue{}, err
+	}
+	v, ok := o.Value.(WeechatInfolistValue)
+	if !ok {
+		return WeechatInfolistValue{}, o.wrongType(OBJ_INL)
+	}
+	return v, nil
 }
 
 // Object representing information needed to be sent.
@@ -45,8 +238,19 @@ type WeechatSendMessage struct {
 	Buffer  string
 }
 
+// The input command to send the message to the buffer.
+func (w *WeechatSendMessage) Command() (commands.Command, error) {
+	return commands.Input(w.Buffer, w.Message)
+}
+
+// The input command as sent on the wire, empty if the message can't be
+// sent to the buffer.
 func (w *WeechatSendMessage) String() string {
-	return fmt.Sprintf("input %v %v\n", w.Buffer, w.Message)
+	cmd, err := w.Command()
+	if err != nil {
+		return ""
+	}
+	return cmd.String()
 }
 
 // Represents a single message from weechat.
@@ -57,9 +261,12 @@ type WeechatMessage struct {
 	// Size of the message after (optional) decompressing.
 	SizeUncompressed int
 
-	// Was zlib compressed used in the message body?
+	// Was the message body compressed?
 	Compressed bool
 
+	// Compression algorithm of the message body: "off", "zlib" or "zstd".
+	Compression string
+
 	// Uncompressed content of the message. If it wasn't compressed
 	// this has the originl body of the message minus the length.
 	Uncompressed []byte
@@ -70,8 +277,12 @@ type WeechatMessage struct {
 	// Object type.
 	Type string
 
-	// List of Weechat objects returned from the message.
+	// The first Weechat object in the message, most messages only
+	// have a single object.
 	Object WeechatObject
+
+	// All the Weechat objects in the message, in order.
+	Objects []WeechatObject
 }
 
 type WeechatDict map[string]WeechatObject
@@ -79,6 +290,9 @@ type WeechatDict map[string]WeechatObject
 type WeechatHdaValue struct {
 	Value []WeechatDict
 	Hpath string
+	// Comma separated list of name:type pairs for the objects in each
+	// item, in the order they were sent on the wire.
+	Keys string
 }
 
 func (hda WeechatHdaValue) DebugPrint() string {
@@ -94,14 +308,25 @@ func (hda WeechatHdaValue) DebugPrint() string {
 	return output
 }
 
+// Infolist is a named list of items, each item being a set of variables.
+type WeechatInfolistValue struct {
+	Name  string
+	Items []WeechatDict
+}
+
+// Fields are tagged with the hdata keys they are read from, see
+// UnmarshalHdata.
 type WeechatBuffer struct {
 	Lines     []*WeechatLine
-	ShortName string
-	FullName  string
-	Number    int32
-	Title     string
-	LocalVars map[WeechatObject]WeechatObject
-	Path      string
+	ShortName string                          `weechat:"short_name"`
+	FullName  string                          `weechat:"full_name"`
+	Number    int32                           `weechat:"number"`
+	Title     string                          `weechat:"title"`
+	LocalVars map[WeechatObject]WeechatObject `weechat:"local_variables"`
+	// Type of the buffer, 0 for formatted and 1 for free content.
+	Type int32 `weechat:"type"`
+	// Pointer of the buffer.
+	Path string `weechat:"__path"`
 }
 
 // Get the Title of the Buffer with color if asked for.
@@ -114,25 +339,42 @@ func (b *WeechatBuffer) TitleStr(shouldColor bool) string {
 }
 
 func (b *WeechatBuffer) GetLines(shouldColor bool) string {
-	var lines []string
-	for _, line := range b.Lines {
-		lines = append(lines, color.ReplaceWeechatColors(line.ToString(shouldColor), color.Colorize))
+	return FormatLines(b.Lines, shouldColor)
+}
+
+// Format the lines to be printed in the ui, one per line, with optional
+// coloring.
+func FormatLines(lines []*WeechatLine, shouldColor bool) string {
+	var formatted []string
+	for _, line := range lines {
+		formatted = append(formatted, color.ReplaceWeechatColors(line.ToString(shouldColor), color.Colorize))
 	}
-	return strings.Join(lines, "\n")
+	return strings.Join(formatted, "\n")
 }
 
 // All the information about a new line.
 type WeechatLine struct {
 	// Path of the buffer.
-	Buffer      string
-	Date        time.Time
-	DatePrinted time.Time
-	Displayed   bool
-	NotifyLevel int
-	Highlight   bool
-	Tags        []string
-	Prefix      string
-	Message     string
+	Buffer      string    `weechat:"buffer"`
+	Date        time.Time `weechat:"date"`
+	DatePrinted time.Time `weechat:"date_printed"`
+	Displayed   bool      `weechat:"displayed"`
+	NotifyLevel int       `weechat:"notify_level"`
+	Highlight   bool      `weechat:"highlight"`
+	Tags        []string  `weechat:"tags_array"`
+	Prefix      string    `weechat:"prefix"`
+	Message     string    `weechat:"message"`
+	// Pointers of the hdata path, the last one is the line data.
+	Path []string `weechat:"__path"`
+}
+
+// Pointer of the line data, which identifies the line in both listlines
+// and _buffer_line_added, empty if it isn't known.
+func (l *WeechatLine) Pointer() string {
+	if len(l.Path) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(l.Path[len(l.Path)-1], "0x")
 }
 
 // Return the string representation of the line to be printed in the
@@ -183,13 +425,15 @@ func (l *WeechatLine) getMessageColor(msg string) string {
 }
 
 type WeechatNick struct {
-	Group       bool
-	Visible     bool
-	Level       int32
-	Name        string
-	Color       string
-	Prefix      string
-	PrefixColor string
+	// Pointer of the buffer the nick is in.
+	Buffer      string `weechat:"__path"`
+	Group       bool   `weechat:"group"`
+	Visible     bool   `weechat:"visible"`
+	Level       int32  `weechat:"level"`
+	Name        string `weechat:"name"`
+	Color       string `weechat:"color"`
+	Prefix      string `weechat:"prefix"`
+	PrefixColor string `weechat:"prefix_color"`
 }
 
 func (n *WeechatNick) String() string {
@@ -199,7 +443,19 @@ func (n *WeechatNick) String() string {
 	return n.Name
 }
 
+// A single buffer in the hotlist, from the hotlist:gui_hotlist(*) hdata.
+type WeechatHotlist struct {
+	// Pointer of the buffer.
+	Buffer   string `weechat:"buffer"`
+	Priority int32  `weechat:"priority"`
+	// Number of lines for each notify level: low, message, private and
+	// highlight.
+	Count []int32 `weechat:"count"`
+}
+
+// A single change in a _nicklist_diff, Diff is one of the NickDiff
+// constants.
 type WeechatNickDiff struct {
 	WeechatNick
-	Diff string
+	Diff string `weechat:"_diff"`
 }
@@ -0,0 +1,172 @@
+package weechat
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Parse a single object from its bytes on the wire.
+func parseRaw(t *testing.T, objType string, data []byte) WeechatObject {
+	t.Helper()
+	var p Protocol
+	obj, rest, err := p.parseObject(objType, data)
+	if err != nil {
+		t.Fatalf("parseObject(%v, %v) error = %v", objType, data, err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("parseObject(%v, %v) left %v bytes", objType, data, len(rest))
+	}
+	return obj
+}
+
+func TestStringAccessor(t *testing.T) {
+	tests := []struct {
+		name    string
+		obj     WeechatObject
+		want    string
+		wantErr error
+	}{
+		{"str", parseRaw(t, OBJ_STR, rawStr("hello")), "hello", nil},
+		{"empty str", parseRaw(t, OBJ_STR, rawStr("")), "", nil},
+		{"NULL str", parseRaw(t, OBJ_STR, rawInt(-1)), "", ErrNull},
+		{"buf", parseRaw(t, OBJ_BUF, rawStr("bytes")), "bytes", nil},
+		{"empty buf", parseRaw(t, OBJ_BUF, rawStr("")), "", nil},
+		{"NULL buf", parseRaw(t, OBJ_BUF, rawInt(-1)), "", ErrNull},
+		{"int", parseRaw(t, OBJ_INT, rawInt(1)), "", ErrWrongType},
+		{"ptr", parseRaw(t, OBJ_PTR, rawPtr("1a2b")), "", ErrWrongType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.obj.String()
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("String() = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+			if null := errors.Is(tt.wantErr, ErrNull); tt.obj.IsNull() != null {
+				t.Errorf("IsNull() = %v, want %v", tt.obj.IsNull(), null)
+			}
+		})
+	}
+}
+
+func TestBytesAccessor(t *testing.T) {
+	if b, err := parseRaw(t, OBJ_BUF, rawStr("")).Bytes(); err != nil || b == nil || len(b) != 0 {
+		t.Errorf("Bytes() of an empty buf = %v, %v, want an empty non nil slice", b, err)
+	}
+	if b, err := parseRaw(t, OBJ_BUF, rawInt(-1)).Bytes(); !errors.Is(err, ErrNull) || b != nil {
+		t.Errorf("Bytes() of a NULL buf = %v, %v, want ErrNull", b, err)
+	}
+	if _, err := parseRaw(t, OBJ_STR, rawStr("x")).Bytes(); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Bytes() of a str error = %v, want ErrWrongType", err)
+	}
+}
+
+func TestPointerAccessor(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr error
+	}{
+		{"pointer", rawPtr("55d0a0001000"), "55d0a0001000", nil},
+		{"NULL as 0", rawPtr("0"), "", ErrNull},
+		{"NULL as empty", rawPtr(""), "", ErrNull},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRaw(t, OBJ_PTR, tt.data).Pointer()
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("Pointer() = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+	if _, err := parseRaw(t, OBJ_STR, rawStr("55d0")).Pointer(); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Pointer() of a str error = %v, want ErrWrongType", err)
+	}
+}
+
+func TestCharAndBoolAccessors(t *testing.T) {
+	tests := []struct {
+		data     byte
+		wantChar byte
+		wantBool bool
+	}{
+		{0, 0, false},
+		{1, 1, true},
+		{'0', '0', false},
+		{'1', '1', true},
+		{0x7f, 0x7f, true},
+		{0x80, 0x80, true},
+		{0xff, 0xff, true},
+	}
+	for _, tt := range tests {
+		obj := parseRaw(t, OBJ_CHR, []byte{tt.data})
+		if c, err := obj.Char(); err != nil || c != tt.wantChar {
+			t.Errorf("Char() of %#x = %#x, %v, want %#x", tt.data, c, err, tt.wantChar)
+		}
+		if b, err := obj.Bool(); err != nil || b != tt.wantBool {
+			t.Errorf("Bool() of %#x = %v, %v, want %v", tt.data, b, err, tt.wantBool)
+		}
+	}
+	obj := parseRaw(t, OBJ_INT, rawInt(1))
+	if _, err := obj.Char(); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Char() of an int error = %v, want ErrWrongType", err)
+	}
+	if _, err := obj.Bool(); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Bool() of an int error = %v, want ErrWrongType", err)
+	}
+}
+
+func TestNumberAccessors(t *testing.T) {
+	if i, err := parseRaw(t, OBJ_INT, rawInt(-42)).Int(); err != nil || i != -42 {
+		t.Errorf("Int() = %v, %v, want -42", i, err)
+	}
+	if _, err := parseRaw(t, OBJ_CHR, []byte{1}).Int(); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Int() of a chr error = %v, want ErrWrongType", err)
+	}
+	if l, err := parseRaw(t, OBJ_LON, rawTime("-1234567890123")).Long(); err != nil || l != -1234567890123 {
+		t.Errorf("Long() = %v, %v, want -1234567890123", l, err)
+	}
+	if _, err := parseRaw(t, OBJ_INT, rawInt(1)).Long(); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Long() of an int error = %v, want ErrWrongType", err)
+	}
+	want := time.Unix(1634515200, 0)
+	if tm, err := parseRaw(t, OBJ_TIM, rawTime("1634515200")).Time(); err != nil || !tm.Equal(want) {
+		t.Errorf("Time() = %v, %v, want %v", tm, err, want)
+	}
+	if _, err := parseRaw(t, OBJ_LON, rawTime("1")).Time(); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Time() of a lon error = %v, want ErrWrongType", err)
+	}
+}
+
+func TestContainerAccessors(t *testing.T) {
+	htb := parseRaw(t, OBJ_HTB, append(append([]byte("strstr"), rawInt(1)...),
+		append(rawStr("key"), rawStr("value")...)...))
+	m, err := htb.Hashtable()
+	if err != nil || len(m) != 1 || m[WeechatObject{OBJ_STR, "key"}] != (WeechatObject{OBJ_STR, "value"}) {
+		t.Errorf("Hashtable() = %v, %v", m, err)
+	}
+	if _, err := htb.Array(); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Array() of a htb error = %v, want ErrWrongType", err)
+	}
+
+	arr := parseRaw(t, OBJ_ARR, append(append([]byte("int"), rawInt(2)...), append(rawInt(1), rawInt(2)...)...))
+	items, err := arr.Array()
+	if err != nil || len(items) != 2 {
+		t.Errorf("Array() = %v, %v", items, err)
+	}
+	if _, err := arr.Hdata(); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Hdata() of an arr error = %v, want ErrWrongType", err)
+	}
+
+	inf := parseRaw(t, OBJ_INF, append(rawStr("version"), rawStr("3.5")...))
+	if name, value, err := inf.Info(); err != nil || name != "version" || value != "3.5" {
+		t.Errorf("Info() = %v, %v, %v", name, value, err)
+	}
+	if _, err := inf.Infolist(); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Infolist() of an inf error = %v, want ErrWrongType", err)
+	}
+	if _, err := (WeechatObject{}).String(); !errors.Is(err, ErrWrongType) {
+		t.Errorf("String() of the zero object error = %v, want ErrWrongType", err)
+	}
+}
@@ -0,0 +1,80 @@
+package weechat
+
+import (
+	"strings"
+)
+
+// Kinds of changes in a _nicklist_diff, in WeechatNickDiff.Diff.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#message_nicklist_diff
+const (
+	// The group that the following added nicks and groups belong to.
+	NickDiffParent  = "^"
+	NickDiffAdded   = "+"
+	NickDiffRemoved = "-"
+	NickDiffUpdated = "*"
+)
+
+// Apply the changes of a _nicklist_diff for a single buffer to its nicks,
+// as sent in reply to the nicklist command, and return the new nicks.
+// Nicks and groups are identified by their name, which weechat keeps
+// unique in a buffer. Added nicks go after their parent group, sorted by
+// name, and added groups after all the nicks of their parent.
+func ApplyNickDiff(nicks []WeechatNick, diff []*WeechatNickDiff) []WeechatNick {
+	nicks = append([]WeechatNick(nil), nicks...)
+	parent := -1
+	for _, d := range diff {
+		switch d.Diff {
+		case NickDiffParent:
+			parent = indexOfNick(nicks, true, d.Name)
+		case NickDiffAdded:
+			i := nickInsertIndex(nicks, parent, &d.WeechatNick)
+			nicks = append(nicks, WeechatNick{})
+			copy(nicks[i+1:], nicks[i:])
+			nicks[i] = d.WeechatNick
+		case NickDiffRemoved:
+			i := indexOfNick(nicks, d.Group, d.Name)
+			if i < 0 {
+				continue
+			}
+			nicks = append(nicks[:i], nicks[i+1:]...)
+			switch {
+			case parent == i:
+				parent = -1
+			case parent > i:
+				parent--
+			}
+		case NickDiffUpdated:
+			if i := indexOfNick(nicks, d.Group, d.Name); i >= 0 {
+				nicks[i] = d.WeechatNick
+			}
+		}
+	}
+	return nicks
+}
+
+// Index of the nick or group with the name, -1 if there is none.
+func indexOfNick(nicks []WeechatNick, group bool, name string) int {
+	for i := range nicks {
+		if nicks[i].Group == group && nicks[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Where to insert a new nick or group in the children of parent, at the
+// end if there is no parent.
+func nickInsertIndex(nicks []WeechatNick, parent int, nick *WeechatNick) int {
+	if parent < 0 {
+		return len(nicks)
+	}
+	name := strings.ToLower(nick.Name)
+	i := parent + 1
+	for i < len(nicks) && !nicks[i].Group {
+		if !nick.Group && strings.ToLower(nicks[i].Name) > name {
+			break
+		}
+		i++
+	}
+	return i
+}
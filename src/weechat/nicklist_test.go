@@ -0,0 +1,82 @@
+package weechat_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/maxking/weeclient/src/weechat"
+	"github.com/maxking/weeclient/src/weechat/commands"
+	"github.com/maxking/weeclient/src/weechat/relaytest"
+)
+
+func nickNames(nicks []weechat.WeechatNick) []string {
+	var names []string
+	for _, nick := range nicks {
+		if nick.Group {
+			names = append(names, "group:"+nick.Name)
+		} else {
+			names = append(names, nick.Prefix+nick.Name)
+		}
+	}
+	return names
+}
+
+func TestStateNickListDiff(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	s.AddBuffer(&relaytest.Buffer{FullName: "irc.libera.#go", Nicks: []weechat.WeechatNick{
+		{Group: true, Name: "root"},
+		{Group: true, Name: "000|o", Visible: true, Level: 1},
+		{Name: "alice", Prefix: "@", Visible: true},
+		{Group: true, Name: "999|...", Visible: true, Level: 1},
+		{Name: "bob", Visible: true},
+		{Name: "dave", Visible: true},
+	}})
+	r := runReconnector(t, s, weechat.DefaultLines)
+	state := weechat.NewState(0)
+	waitFor(t, r.Events(), state, "hotlist")
+	if err := r.Client().Ping(context.Background()); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+
+	// A diff before the nicklist was fetched would leave only the nicks
+	// that changed.
+	s.NicklistDiff("irc.libera.#go",
+		weechat.WeechatNickDiff{Diff: weechat.NickDiffParent, WeechatNick: weechat.WeechatNick{Group: true, Name: "999|..."}},
+		weechat.WeechatNickDiff{Diff: weechat.NickDiffAdded, WeechatNick: weechat.WeechatNick{Name: "carol", Visible: true}},
+	)
+	waitFor(t, r.Events(), state, "_nicklist_diff")
+	buf, _ := state.BufferByName("irc.libera.#go")
+	if buf.NicksLoaded || len(buf.Nicks) != 0 {
+		t.Fatalf("nicks before the nicklist = %v, loaded %v, want none", nickNames(buf.Nicks), buf.NicksLoaded)
+	}
+
+	cmd, err := commands.Nicklist("irc.libera.#go")
+	if err != nil {
+		t.Fatalf("Nicklist() error = %v", err)
+	}
+	if err := r.Command(cmd.WithID("nicklist")); err != nil {
+		t.Fatalf("Command() error = %v", err)
+	}
+	waitFor(t, r.Events(), state, "nicklist")
+	buf, _ = state.BufferByName("irc.libera.#go")
+	if !buf.NicksLoaded || len(buf.Nicks) != 7 {
+		t.Fatalf("nicks = %v, loaded %v, want 7", nickNames(buf.Nicks), buf.NicksLoaded)
+	}
+
+	s.NicklistDiff("irc.libera.#go",
+		weechat.WeechatNickDiff{Diff: weechat.NickDiffParent, WeechatNick: weechat.WeechatNick{Group: true, Name: "999|..."}},
+		weechat.WeechatNickDiff{Diff: weechat.NickDiffRemoved, WeechatNick: weechat.WeechatNick{Name: "bob"}},
+		weechat.WeechatNickDiff{Diff: weechat.NickDiffUpdated, WeechatNick: weechat.WeechatNick{Name: "alice", Prefix: "+", Visible: true}},
+	)
+	waitFor(t, r.Events(), state, "_nicklist_diff")
+	buf, _ = state.BufferByName("irc.libera.#go")
+	got, want := nickNames(buf.Nicks), nickNames(s.Buffer("irc.libera.#go").Nicks)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("nicks = %v, want %v", got, want)
+	}
+	if len(got) != 6 || got[2] != "+alice" {
+		t.Errorf("nicks = %v, want +alice and no bob", got)
+	}
+}
@@ -1,11 +1,9 @@
 package weechat
 
 import (
-	"bytes"
-	"compress/zlib"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
 	"strings"
 )
 
@@ -13,6 +11,9 @@ import (
 // parses messages from here:
 // https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#messages
 type Protocol struct {
+	// Maximum size of the body of a message once decompressed,
+	// DefaultMaxUncompressedSize if 0.
+	MaxUncompressedSize int
 }
 
 // All the Core Weechat objecct types.
@@ -34,52 +35,149 @@ const (
 // Debug.
 var DebugPrint = false
 
+// Kinds of errors found when parsing a message. A ParseError wraps one of
+// these, so they can be checked with errors.Is().
+var (
+	// The data ended before the object was completely parsed.
+	ErrTruncated = errors.New("truncated data")
+	// The object type isn't one of the Core weechat object types.
+	ErrUnknownType = errors.New("unknown object type")
+	// A length or count was negative.
+	ErrNegativeLength = errors.New("negative length")
+	// There were more bytes than the length of the message.
+	ErrTrailingBytes = errors.New("trailing bytes")
+	// The compression flag isn't one of the known values.
+	ErrUnknownCompression = errors.New("unknown compression")
+	// The body of the message couldn't be decompressed.
+	ErrDecompress = errors.New("invalid compressed data")
+	// The body of the message is larger than
+	// Protocol.MaxUncompressedSize once decompressed.
+	ErrUncompressedTooLarge = errors.New("uncompressed message too large")
+)
+
+// ParseError is returned when a message can't be parsed. It records what
+// kind of error it was, the object type being parsed and the byte offset
+// where it failed.
+type ParseError struct {
+	// One of the Err* kinds of errors above.
+	Err error
+	// Type of the object that was being parsed.
+	ObjType string
+	// Offset in bytes from the start of the message, including the 4
+	// byte length and the compression flag. For compressed messages,
+	// this is the offset in the uncompressed message. It is only set
+	// by Decode().
+	Offset int
+	// More details about the error.
+	Detail string
+
+	// Number of bytes left to parse when the error happened, used to
+	// find the Offset.
+	remaining int
+}
+
+func (e *ParseError) Error() string {
+	msg := fmt.Sprintf("failed to parse %v at offset %v: %v", e.ObjType, e.Offset, e.Err)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Create a new ParseError for the given remaining data.
+func parseError(kind error, objType string, data []byte, format string, args ...interface{}) *ParseError {
+	return &ParseError{
+		Err:       kind,
+		ObjType:   objType,
+		Detail:    fmt.Sprintf(format, args...),
+		remaining: len(data),
+	}
+}
+
+// Set the Offset of a ParseError, given the size of the data that was
+// being parsed and where that data starts in the message.
+func setOffset(err error, start int, size int) error {
+	var perr *ParseError
+	if errors.As(err, &perr) {
+		perr.Offset = start + size - perr.remaining
+	}
+	return err
+}
+
 // This is the primary Pubic method to decode a single Weechat Message. It
-// support zlib decompression of the compressed message.
-func (p *Protocol) Decode(data []byte) (msg *WeechatMessage, err error) {
-	var objType, msgid string
-	// Handle error in parsing the msgBody.
-	defer func() {
-		if r := recover(); r != nil {
-			err = fmt.Errorf("failed to parse the object of type %v: %v", objType, r)
+// supports messages compressed with zlib and zstd. The data must be
+// exactly one message, any error in parsing is returned as a *ParseError.
+// A message can have more than one object, all of them are in Objects and
+// the first one is also in Object.
+func (p *Protocol) Decode(data []byte) (*WeechatMessage, error) {
+	msglen, compression, msgBody, err := p.parseInitial(data)
+	if err != nil {
+		return nil, setOffset(err, 0, len(data))
+	}
+	compressedSize := len(msgBody)
+	max := p.MaxUncompressedSize
+	if max == 0 {
+		max = DefaultMaxUncompressedSize
+	}
+	if msgBody, err = decompress(compression, msgBody, max); err != nil {
+		return nil, setOffset(err, 5, compressedSize)
+	}
+	sizeUncompressed := len(msgBody)
+	// Offsets in the body start after the length and compression flag.
+	fail := func(err error) (*WeechatMessage, error) {
+		return nil, setOffset(err, 5, sizeUncompressed)
+	}
+
+	msgid, remaining, err := p.ParseString(msgBody)
+	if err != nil {
+		return fail(err)
+	}
+
+	// Parse all the objects until the message is consumed, some messages
+	// like _upgrade have no objects at all.
+	var objType string
+	var objects []WeechatObject
+	for len(remaining) > 0 {
+		var t string
+		var obj WeechatObject
+		t, remaining, err = p.parseType(remaining)
+		if err != nil {
+			return fail(err)
 		}
-	}()
-	msglen, compressed, msgBody, _ := p.parseInitial(data)
-	if compressed {
-		var out bytes.Buffer
-		in := bytes.NewReader(msgBody)
-		r, err := zlib.NewReader(in)
+		obj, remaining, err = p.parseObject(t, remaining)
 		if err != nil {
-			return nil, fmt.Errorf(
-				"failed to decompress zlib compressed data")
+			return fail(err)
 		}
-		io.Copy(&out, r)
-		r.Close()
-		msgBody = out.Bytes()
+		if objType == "" {
+			objType = t
+		}
+		objects = append(objects, obj)
 	}
-	msgid, msgBody = p.ParseString(msgBody)
-	objType, msgBody = p.parseType(msgBody)
-
-	obj, _ := p.parseObject(objType, msgBody)
-	// fmt.Printf("Total size: %v\nCompression: %v\nId: %v\nType: %v\n======\n",
-	// 	msglen, compressed, msgid, objType)
 
 	// set the message and return
-	msg = &WeechatMessage{
+	msg := &WeechatMessage{
 		Size:             int(msglen),
-		Compressed:       compressed,
-		SizeUncompressed: len(msgBody),
+		Compressed:       compression != CompressionOff,
+		Compression:      compression,
+		SizeUncompressed: sizeUncompressed,
 		Msgid:            msgid,
 		Type:             objType,
-		Object:           obj,
+		Objects:          objects,
+	}
+	if len(objects) > 0 {
+		msg.Object = objects[0]
 	}
-	return
+	return msg, nil
 }
 
 // Parse the objects as defined in the list here:
 // https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#objects
 func (p *Protocol) parseObject(
-	objType string, data []byte) (WeechatObject, []byte) {
+	objType string, data []byte) (WeechatObject, []byte, error) {
 
 	switch objType {
 	case OBJ_CHR:
@@ -91,7 +189,7 @@ func (p *Protocol) parseObject(
 	case OBJ_STR:
 		return p.parseStr(data)
 	case OBJ_BUF:
-		return p.parseStr(data)
+		return p.parseBuf(data)
 	case OBJ_PTR:
 		return p.parsePointer(data)
 	case OBJ_TIM:
@@ -107,232 +205,358 @@ func (p *Protocol) parseObject(
 	case OBJ_INL:
 		return p.parseInfoListContent(data)
 	default:
-		panic(fmt.Errorf("parsing of type %v is not implemented yet", objType))
+		return WeechatObject{}, data, parseError(ErrUnknownType, objType, data,
+			"parsing of type %q is not implemented", objType)
 	}
 }
 
-// Parse the length of the message body.
-func (p *Protocol) parseInitial(data []byte) (int32, bool, []byte, []byte) {
-	len, _ := p.ParseLen(data)
-	compressed := bytes.Equal(data[4:5], []byte{01})
-	msgBody := data[5:len]
-	return len, compressed, msgBody, data[len:]
+// Parse the length of the message and the compression flag. Returns the
+// length, the compression algorithm and the body of the message.
+func (p *Protocol) parseInitial(data []byte) (int32, string, []byte, error) {
+	length, remaining, err := p.ParseLen(data)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	if length < 0 {
+		return 0, "", nil, parseError(ErrNegativeLength, "message", remaining,
+			"message length %v", length)
+	}
+	if length < 5 || int(length) > len(data) {
+		return 0, "", nil, parseError(ErrTruncated, "message", remaining,
+			"message length %v, got %v bytes", length, len(data))
+	}
+	if int(length) < len(data) {
+		return 0, "", nil, parseError(ErrTrailingBytes, "message", data[length:],
+			"%v bytes after the end of the message", len(data)-int(length))
+	}
+	compression, ok := compressionFlags[data[4]]
+	if !ok {
+		return 0, "", nil, parseError(ErrUnknownCompression, "message", data[4:],
+			"compression flag %v", data[4])
+	}
+	return length, compression, data[5:length], nil
 }
 
-// Parse a single string.
+// Parse a single string. A NULL string (length -1) is returned as an empty
+// string.
 // https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_string
-func (p *Protocol) ParseString(data []byte) (string, []byte) {
-	var length int32
-	length, data = p.ParseLen(data)
-	// 2147483647 is the value for int_max in 4byte singed integer.
-	if length >= 2147483647 {
-		// panic(fmt.Sprintf("Found length larger than int_max %v", length))
-		return "", data
-	} else if length <= 0 {
-		if DebugPrint {
-			fmt.Printf("Found negative length %v\n", length)
-		}
-		return "", data
+func (p *Protocol) ParseString(data []byte) (string, []byte, error) {
+	length, remaining, err := p.ParseLen(data)
+	if err != nil {
+		return "", data, err
+	}
+	if length == -1 {
+		return "", remaining, nil
 	}
-	if int(length) > len(data) {
-		panic(fmt.Sprintf("Found string length larger than the data, length: %v data len: %v", length, len(data)))
+	if length < 0 {
+		return "", data, parseError(ErrNegativeLength, OBJ_STR, data,
+			"string length %v", length)
 	}
-	// fmt.Printf("Length of string: %v value: %v\n", len, str)
-	return string(data[:length]), data[length:]
+	if int(length) > len(remaining) {
+		return "", data, parseError(ErrTruncated, OBJ_STR, data,
+			"string length %v larger than the data %v", length, len(remaining))
+	}
+	return string(remaining[:length]), remaining[length:], nil
 }
 
-// Parse a single string.
+// Parse a single string. A NULL string has a nil Value, so that it can be
+// told apart from an empty string.
 // https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_string
-func (p *Protocol) parseStr(data []byte) (WeechatObject, []byte) {
-	var strval string
-	strval, data = p.ParseString(data)
-	return WeechatObject{OBJ_STR, strval}, data
+func (p *Protocol) parseStr(data []byte) (WeechatObject, []byte, error) {
+	if p.isNull(data) {
+		return WeechatObject{OBJ_STR, nil}, data[4:], nil
+	}
+	strval, data, err := p.ParseString(data)
+	return WeechatObject{OBJ_STR, strval}, data, err
+}
+
+// Parse a buffer, which is parsed like a string but the Value is []byte.
+// A NULL buffer has a nil Value.
+// https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_buffer
+func (p *Protocol) parseBuf(data []byte) (WeechatObject, []byte, error) {
+	if p.isNull(data) {
+		return WeechatObject{OBJ_BUF, nil}, data[4:], nil
+	}
+	strval, data, err := p.ParseString(data)
+	return WeechatObject{OBJ_BUF, []byte(strval)}, data, err
+}
+
+// Check if the data starts with the length of a NULL string or buffer.
+func (p *Protocol) isNull(data []byte) bool {
+	return len(data) >= 4 && int32(binary.BigEndian.Uint32(data[:4])) == -1
 }
 
 // Parse a 3 letter object type, usually one of:
 // https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#objects
-// There is currently no check built to handle object types we don't know
-// about and it will essentially end up panic in parseObject if an unknown
-// type is passed to it.
-func (p *Protocol) parseType(data []byte) (string, []byte) {
-	return string(data[:3]), data[3:]
+// Unknown types are only found when parseObject is called with them.
+func (p *Protocol) parseType(data []byte) (string, []byte, error) {
+	if len(data) < 3 {
+		return "", data, parseError(ErrTruncated, "type", data,
+			"need 3 bytes, got %v", len(data))
+	}
+	return string(data[:3]), data[3:], nil
 }
 
 // Parse the length of a string/message/anything. Just a
 // proxy for parseInt.
-func (p *Protocol) ParseLen(data []byte) (int32, []byte) {
-	var val WeechatObject
-	val, data = p.parseInt(data)
-	return val.Value.(int32), data
+func (p *Protocol) ParseLen(data []byte) (int32, []byte, error) {
+	val, data, err := p.parseInt(data)
+	if err != nil {
+		return 0, data, err
+	}
+	return val.Value.(int32), data, nil
+}
+
+// Parse a count of objects. Every object takes at least one byte, so a
+// count larger than the remaining data can only be a truncated message
+// and we don't want to allocate for it.
+func (p *Protocol) parseCount(objType string, data []byte) (int, []byte, error) {
+	count, remaining, err := p.ParseLen(data)
+	if err != nil {
+		return 0, data, err
+	}
+	if count < 0 {
+		return 0, data, parseError(ErrNegativeLength, objType, data,
+			"count %v", count)
+	}
+	if int(count) > len(remaining) {
+		return 0, data, parseError(ErrTruncated, objType, data,
+			"count %v larger than the data %v", count, len(remaining))
+	}
+	return int(count), remaining, nil
 }
 
 // Parse 4 byte signed Integer.
 // https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_integer
-func (p *Protocol) parseInt(data []byte) (WeechatObject, []byte) {
+func (p *Protocol) parseInt(data []byte) (WeechatObject, []byte, error) {
 	if len(data) < 4 {
-		return WeechatObject{OBJ_INT, 0}, data
+		return WeechatObject{OBJ_INT, int32(0)}, data, parseError(ErrTruncated, OBJ_INT, data,
+			"need 4 bytes, got %v", len(data))
 	}
 	len := binary.BigEndian.Uint32(data[:4])
-	// fmt.Printf("Parsed int of value: %v\n", len)
-	return WeechatObject{OBJ_INT, int32(len)}, data[4:]
+	return WeechatObject{OBJ_INT, int32(len)}, data[4:], nil
 }
 
 // Parse time, which is essentially a string with a 1 byte length
 // in the start.
 // https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_time
-func (p *Protocol) parseTime(data []byte) (WeechatObject, []byte) {
-	var pointer WeechatObject
-	pointer, data = p.parsePointer(data)
-	pointer.ObjType = OBJ_TIM
-	return pointer, data
+func (p *Protocol) parseTime(data []byte) (WeechatObject, []byte, error) {
+	value, data, err := p.parseSmallString(OBJ_TIM, data)
+	return WeechatObject{OBJ_TIM, value}, data, err
 }
 
 // Parse a single character of length 1 byte.
 // https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_char
-func (p *Protocol) parseChar(data []byte) (WeechatObject, []byte) {
-	return WeechatObject{OBJ_CHR, string(data[0])}, data[1:]
+func (p *Protocol) parseChar(data []byte) (WeechatObject, []byte, error) {
+	if len(data) < 1 {
+		return WeechatObject{}, data, parseError(ErrTruncated, OBJ_CHR, data, "need 1 byte")
+	}
+	// string(data[0]) would be the UTF-8 encoding of the rune, 2 bytes
+	// from 0x80.
+	return WeechatObject{OBJ_CHR, string(data[:1])}, data[1:], nil
 }
 
 // Parse a hash table datatype. It starts with two Type (3byte) (key type, value type)
 // and then the count (4 byte integer) and then count number of key value pairs.
 // https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_hashtable
-func (p *Protocol) parseHashTable(data []byte) (WeechatObject, []byte) {
+func (p *Protocol) parseHashTable(data []byte) (WeechatObject, []byte, error) {
 	var key_type, value_type string
-	var count int32
-	key_type, data = p.parseType(data)
-	value_type, data = p.parseType(data)
-	count, data = p.ParseLen(data)
+	var count int
+	var err error
+	if key_type, data, err = p.parseType(data); err != nil {
+		return WeechatObject{}, data, err
+	}
+	if value_type, data, err = p.parseType(data); err != nil {
+		return WeechatObject{}, data, err
+	}
+	// Keys are used in a Go map, so they can only be simple types.
+	switch key_type {
+	case OBJ_CHR, OBJ_INT, OBJ_LON, OBJ_STR, OBJ_PTR, OBJ_TIM:
+	default:
+		return WeechatObject{}, data, parseError(ErrUnknownType, OBJ_HTB, data,
+			"type %q can't be used for hashtable keys", key_type)
+	}
+	if count, data, err = p.parseCount(OBJ_HTB, data); err != nil {
+		return WeechatObject{}, data, err
+	}
 
 	var key, value WeechatObject
 	hashtable := make(map[WeechatObject]WeechatObject, count)
 
-	// fmt.Printf("Key types: %v, value types: %v\n", key_type, value_type)
-	for i := 0; i < int(count); i++ {
-		key, data = p.parseObject(key_type, data)
-		value, data = p.parseObject(value_type, data)
+	for i := 0; i < count; i++ {
+		if key, data, err = p.parseObject(key_type, data); err != nil {
+			return WeechatObject{}, data, err
+		}
+		if value, data, err = p.parseObject(value_type, data); err != nil {
+			return WeechatObject{}, data, err
+		}
 		hashtable[key] = value
 	}
-	// fmt.Println("=====Finished parsing of hash table.")
-	return WeechatObject{OBJ_HTB, hashtable}, data
+	return WeechatObject{OBJ_HTB, hashtable}, data, nil
 }
 
 // Parse an array. Objects of a single type.
 // 3 bytes Type, 4 byte count (integer) and then count number of objects.
 // https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_array
-func (p *Protocol) parseArray(data []byte) (WeechatObject, []byte) {
+func (p *Protocol) parseArray(data []byte) (WeechatObject, []byte, error) {
 	var objType string
-	var count int32
+	var count int
 	var value WeechatObject
+	var err error
 	// parse the type of the objects in the array.
-	objType, data = p.parseType(data)
-
-	count, data = p.ParseLen(data)
-	arr := make([]WeechatObject, count)
+	if objType, data, err = p.parseType(data); err != nil {
+		return WeechatObject{}, data, err
+	}
+	if count, data, err = p.parseCount(OBJ_ARR, data); err != nil {
+		return WeechatObject{}, data, err
+	}
+	arr := make([]WeechatObject, 0, count)
 
-	for i := 0; i < int(count); i++ {
-		value, data = p.parseObject(objType, data)
+	for i := 0; i < count; i++ {
+		if value, data, err = p.parseObject(objType, data); err != nil {
+			return WeechatObject{}, data, err
+		}
 		arr = append(arr, value)
 	}
 
-	return WeechatObject{OBJ_ARR, arr}, data
+	return WeechatObject{OBJ_ARR, arr}, data, nil
 }
 
-// Parse Infolist, which is a list of key-value pairs with key type string and
-// arbitrary value type.
+// Parse Infolist, which has a name and a list of items, each item being a
+// list of variables with key type string and arbitrary value type.
 // https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_infolist
-func (p *Protocol) parseInfoListContent(data []byte) (WeechatObject, []byte) {
-	var count int32
-	var objType, key string
+func (p *Protocol) parseInfoListContent(data []byte) (WeechatObject, []byte, error) {
+	var name, key, objType string
+	var count, varCount int
 	var value WeechatObject
+	var err error
 	// parse name
-	_, data = p.parseStr(data)
-	// parse count
-	count, data = p.ParseLen(data)
-	// parse count numer of items.
-
-	infolist := make(WeechatDict, count)
+	if name, data, err = p.ParseString(data); err != nil {
+		return WeechatObject{}, data, err
+	}
+	// parse count of items.
+	if count, data, err = p.parseCount(OBJ_INL, data); err != nil {
+		return WeechatObject{}, data, err
+	}
 
-	for i := 0; i < int(count); i++ {
-		// parse name.
-		key, data = p.ParseString(data)
-		// parse type.
-		objType, data = p.parseType(data)
-		// parse the value.
-		value, data = p.parseObject(objType, data)
-		infolist[key] = value
+	infolist := WeechatInfolistValue{Name: name, Items: make([]WeechatDict, 0, count)}
 
+	for i := 0; i < count; i++ {
+		// each item starts with the count of variables in it.
+		if varCount, data, err = p.parseCount(OBJ_INL, data); err != nil {
+			return WeechatObject{}, data, err
+		}
+		item := make(WeechatDict, varCount)
+		for j := 0; j < varCount; j++ {
+			// parse name.
+			if key, data, err = p.ParseString(data); err != nil {
+				return WeechatObject{}, data, err
+			}
+			// parse type.
+			if objType, data, err = p.parseType(data); err != nil {
+				return WeechatObject{}, data, err
+			}
+			// parse the value.
+			if value, data, err = p.parseObject(objType, data); err != nil {
+				return WeechatObject{}, data, err
+			}
+			item[key] = value
+		}
+		infolist.Items = append(infolist.Items, item)
 	}
-	return WeechatObject{OBJ_INL, infolist}, data
+	return WeechatObject{OBJ_INL, infolist}, data, nil
 }
 
 // Parse Info, which is essentially a key-value pair of type string.
 // https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_info
-func (p *Protocol) parseInfo(data []byte) (WeechatObject, []byte) {
+func (p *Protocol) parseInfo(data []byte) (WeechatObject, []byte, error) {
 	info := make(map[string]string)
 	var key, value string
+	var err error
 	// key
-	key, data = p.ParseString(data)
+	if key, data, err = p.ParseString(data); err != nil {
+		return WeechatObject{}, data, err
+	}
 	// value
-	value, data = p.ParseString(data)
+	if value, data, err = p.ParseString(data); err != nil {
+		return WeechatObject{}, data, err
+	}
 	info[key] = value
 
-	return WeechatObject{OBJ_INF, info}, data
+	return WeechatObject{OBJ_INF, info}, data, nil
 }
 
 // Parse Long integer, which is essentially parsed like a Pointer,
 // single byt length and then string.
 // https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_long_integer
-func (p *Protocol) parseLongInt(data []byte) (WeechatObject, []byte) {
-	var pointer WeechatObject
-	pointer, data = p.parsePointer(data)
-	pointer.ObjType = OBJ_LON
-	return pointer, data
+func (p *Protocol) parseLongInt(data []byte) (WeechatObject, []byte, error) {
+	value, data, err := p.parseSmallString(OBJ_LON, data)
+	return WeechatObject{OBJ_LON, value}, data, err
 }
 
 // Parse hdata. This is the most complex data structure to be
 // parsed so just read the explanation in docs.
 // https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_hdata
-func (p *Protocol) parseHda(data []byte) (WeechatObject, []byte) {
-	// fmt.Println("========= Parsing object: hda ========")
+func (p *Protocol) parseHda(data []byte) (WeechatObject, []byte, error) {
 	var hpath, keys string
 	var remaining []byte
-	var count int32
+	var count int
+	var err error
 	// Parse the hpath.
-	hpath, remaining = p.ParseString(data)
+	if hpath, remaining, err = p.ParseString(data); err != nil {
+		return WeechatObject{}, remaining, err
+	}
 	// parse the keys.
-	keys, remaining = p.ParseString(remaining)
+	if keys, remaining, err = p.ParseString(remaining); err != nil {
+		return WeechatObject{}, remaining, err
+	}
 	// parse the count.
-	count, remaining = p.ParseLen(remaining)
+	if count, remaining, err = p.parseCount(OBJ_HDA, remaining); err != nil {
+		return WeechatObject{}, remaining, err
+	}
 
 	if DebugPrint {
 		fmt.Printf("hpath: %v\nkeys: %v\ncount: %v\n", hpath, keys, count)
 	}
 	pointerCount := len(strings.Split(hpath, "/"))
 
-	// Parse objects based on keys "count" number of times.
-	objects := strings.Split(keys, ",")
-	// fmt.Printf("hapth: %v\n", hpath)
+	// Parse objects based on keys "count" number of times. Each key
+	// is of the form name:type.
+	var objects [][]string
+	if keys != "" {
+		for _, obj := range strings.Split(keys, ",") {
+			s := strings.Split(obj, ":")
+			if len(s) != 2 {
+				return WeechatObject{}, remaining, parseError(ErrUnknownType, OBJ_HDA, remaining,
+					"hdata key %q is not of the form name:type", obj)
+			}
+			objects = append(objects, s)
+		}
+	}
 
 	// Hdata is modeled as list of dictionaries where the key type is
 	// string and the value type is defined in the "keys" section, but
 	// is essentially consistent across the list.
-	var hda []WeechatDict
+	hda := make([]WeechatDict, 0, count)
 	var objVal WeechatObject
 	var pointers []string
 
-	for j := 0; j < int(count); j++ {
-		// Parse out the pointers, there is no use of them that I
-		// can think of. Perhaps, in future, we can use it somewhere.
-		pointers, remaining = p.parsePointers(pointerCount, remaining)
+	for j := 0; j < count; j++ {
+		// Parse out the pointers, the first one is usually the pointer
+		// of the buffer the item belongs to.
+		if pointers, remaining, err = p.parsePointers(pointerCount, remaining); err != nil {
+			return WeechatObject{}, remaining, err
+		}
 
 		hdamap := make(WeechatDict, len(objects)+1)
 		// sorta bad pattern here to jam in the pointers into the hda
 		// map so that it can be used later.
 		hdamap["__path"] = WeechatObject{"__path", pointers}
 		for i, obj := range objects {
-			s := strings.Split(obj, ":")
-			objName, objtype := s[0], s[1]
-			objVal, remaining = p.parseObject(objtype, remaining)
+			objName, objtype := obj[0], obj[1]
+			if objVal, remaining, err = p.parseObject(objtype, remaining); err != nil {
+				return WeechatObject{}, remaining, err
+			}
 			if DebugPrint {
 				fmt.Printf("%v/%v :%v. Parsed %v of type %v value %v\n",
 					j, count, i, objName, objtype, objVal)
@@ -345,40 +569,59 @@ func (p *Protocol) parseHda(data []byte) (WeechatObject, []byte) {
 		// Now add it to the hda list.
 		hda = append(hda, hdamap)
 	}
-	// fmt.Printf("hpath:%v\nkeys:%v\ncount:%v\npointerCount: %v\nvalues:%v\n",
-	// hpath, keys, count, pointerCount, values)
-	// fmt.Println("========= Finished parsing hda ========")
 
 	// Wrap the values into a specific values object that includes the Hpath
-	return WeechatObject{OBJ_HDA, WeechatHdaValue{Value: hda, Hpath: hpath}}, remaining
+	return WeechatObject{OBJ_HDA, WeechatHdaValue{Value: hda, Hpath: hpath, Keys: keys}}, remaining, nil
 }
 
 // Parse count number of pointers. Not an actual datatype.
-func (p *Protocol) parsePointers(count int, data []byte) ([]string, []byte) {
-	pointers := make([]string, count)
+func (p *Protocol) parsePointers(count int, data []byte) ([]string, []byte, error) {
+	pointers := make([]string, 0, count)
 	var pointer WeechatObject
+	var err error
 	for i := 0; i < count; i++ {
-		pointer, data = p.parsePointer(data)
-		pointers = append(pointers, pointer.Value.(string))
+		if pointer, data, err = p.parsePointer(data); err != nil {
+			return nil, data, err
+		}
+		value, _ := pointer.Value.(string)
+		pointers = append(pointers, value)
 	}
-	// fmt.Printf("Parsed %v pointers\n", count)
-	return pointers, data
+	return pointers, data, nil
 }
 
 // Parse a single byte integer, used to denote length of
 // pointer or long integer. Not an actual datatype.
-func (p *Protocol) parseSmallint(data []byte) int {
-	return int(data[0])
+func (p *Protocol) parseSmallint(objType string, data []byte) (int, []byte, error) {
+	if len(data) < 1 {
+		return 0, data, parseError(ErrTruncated, objType, data, "need 1 byte for the length")
+	}
+	return int(data[0]), data[1:], nil
+}
+
+// Parse a string with a single byte length, used for pointers, long
+// integers and time. Not an actual datatype.
+func (p *Protocol) parseSmallString(objType string, data []byte) (string, []byte, error) {
+	length, remaining, err := p.parseSmallint(objType, data)
+	if err != nil {
+		return "", data, err
+	}
+	if length > len(remaining) {
+		return "", data, parseError(ErrTruncated, objType, data,
+			"length %v larger than the data %v", length, len(remaining))
+	}
+	return string(remaining[:length]), remaining[length:], nil
 }
 
 // Parse a single pointer. Single byte length and then length
-// long string.
+// long string. A NULL pointer, sent as "0", has a nil Value.
 // https://weechat.org/files/doc/stable/weechat_relay_protocol.en.html#object_pointer
-func (p *Protocol) parsePointer(data []byte) (WeechatObject, []byte) {
-	len := p.parseSmallint(data)
-	if len == 0 {
-		return WeechatObject{OBJ_PTR, ""}, data[2:]
+func (p *Protocol) parsePointer(data []byte) (WeechatObject, []byte, error) {
+	pointer, data, err := p.parseSmallString(OBJ_PTR, data)
+	if err != nil {
+		return WeechatObject{}, data, err
+	}
+	if pointer == "" || pointer == "0" {
+		return WeechatObject{OBJ_PTR, nil}, data, nil
 	}
-	pointer := string(data[1 : len+1])
-	return WeechatObject{OBJ_PTR, pointer}, data[len+1:]
+	return WeechatObject{OBJ_PTR, pointer}, data, nil
 }
@@ -0,0 +1,95 @@
+package weechat
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// A NULL msgid, the objects start after it at offset 9.
+const nullMsgid = "\xff\xff\xff\xff"
+
+// Build an uncompressed message with the body.
+func message(body string) []byte {
+	data := make([]byte, 5, 5+len(body))
+	binary.BigEndian.PutUint32(data, uint32(5+len(body)))
+	return append(data, body...)
+}
+
+// Build a zlib compressed message with the body.
+func zlibMessage(t *testing.T, body string) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w := zlib.NewWriter(&out)
+	w.Write([]byte(body))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := message(out.String())
+	data[4] = 1
+	return data
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		wantErr    error
+		wantType   string
+		wantOffset int
+	}{
+		{"truncated length", []byte{0, 0}, ErrTruncated, OBJ_INT, 0},
+		{"length larger than the data", message(nullMsgid + "x")[:9], ErrTruncated, "message", 4},
+		{"negative length", []byte{0xff, 0xff, 0xff, 0xfe, 0}, ErrNegativeLength, "message", 4},
+		{"trailing bytes", append(message(nullMsgid), "xx"...), ErrTrailingBytes, "message", 9},
+		{"unknown compression", append([]byte{0, 0, 0, 9, 3}, nullMsgid...), ErrUnknownCompression, "message", 4},
+		{"truncated msgid", message("\x00\x00\x00\x10ab"), ErrTruncated, OBJ_STR, 5},
+		{"truncated type", message(nullMsgid + "st"), ErrTruncated, "type", 9},
+		{"unknown type", message(nullMsgid + "xyz\x00"), ErrUnknownType, "xyz", 12},
+		{"truncated str", message(nullMsgid + "str\x00\x00\x00\x10ab"), ErrTruncated, OBJ_STR, 12},
+		{"negative str length", message(nullMsgid + "str\xff\xff\xff\xfe"), ErrNegativeLength, OBJ_STR, 12},
+		{"negative arr count", message(nullMsgid + "arrint\xff\xff\xff\xfe"), ErrNegativeLength, OBJ_ARR, 15},
+		{"arr count larger than the data", message(nullMsgid + "arrstr\x00\x00\x01\x00"), ErrTruncated, OBJ_ARR, 15},
+		{"truncated int in arr", message(nullMsgid + "arrint\x00\x00\x00\x02\x00\x00\x00\x01\x00\x00"), ErrTruncated, OBJ_INT, 23},
+		{"truncated second object", message(nullMsgid + "str\x00\x00\x00\x01aint\x00"), ErrTruncated, OBJ_INT, 20},
+		{"truncated compressed str", zlibMessage(t, nullMsgid+"str\x00\x00\x00\x10ab"), ErrTruncated, OBJ_STR, 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Protocol
+			msg, err := p.Decode(tt.data)
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("Decode() = %+v, %v, want a *ParseError", msg, err)
+			}
+			if !errors.Is(err, tt.wantErr) || perr.ObjType != tt.wantType || perr.Offset != tt.wantOffset {
+				t.Errorf("Decode() error = %v, want %v parsing %v at offset %v",
+					err, tt.wantErr, tt.wantType, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func TestDecodeMultipleObjects(t *testing.T) {
+	var p Protocol
+	msg, err := p.Decode(message("\x00\x00\x00\x04testint\x00\x00\x00\x2astr\x00\x00\x00\x02hichrA"))
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	want := []WeechatObject{{OBJ_INT, int32(42)}, {OBJ_STR, "hi"}, {OBJ_CHR, "A"}}
+	if msg.Msgid != "test" || msg.Type != OBJ_INT || !reflect.DeepEqual(msg.Object, want[0]) {
+		t.Errorf("Decode() = %v %v %#v, want test with an int first", msg.Msgid, msg.Type, msg.Object)
+	}
+	if !reflect.DeepEqual(msg.Objects, want) {
+		t.Errorf("Objects = %#v, want %#v", msg.Objects, want)
+	}
+
+	// Messages like _upgrade have no objects at all.
+	msg, err = p.Decode(message("\x00\x00\x00\x08_upgrade"))
+	if err != nil || msg.Msgid != "_upgrade" || msg.Type != "" || len(msg.Objects) != 0 {
+		t.Errorf("Decode() = %+v, %v, want _upgrade without objects", msg, err)
+	}
+}
@@ -0,0 +1,317 @@
+package weechat
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Value of ConnOptions.Proxy to connect directly even if there is a proxy
+// in the environment.
+const ProxyDirect = "direct"
+
+// Returned when the proxy refuses to connect to the relay.
+var ErrProxyRefused = errors.New("proxy refused the connection")
+
+// Get the URL of the proxy to connect to the address, from the proxy
+// option or the environment. Returns nil to connect directly.
+func proxyURL(proxy string, address string) (*url.URL, error) {
+	switch proxy {
+	case ProxyDirect:
+		return nil, nil
+	case "":
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		if proxy = proxyFromEnvironment(host); proxy == "" {
+			return nil, nil
+		}
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", proxy, err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, expected socks5, socks5h, http or https", u.Scheme)
+	}
+	if u.Port() == "" {
+		port := map[string]string{"socks5": "1080", "socks5h": "1080", "http": "80", "https": "443"}[u.Scheme]
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// Proxy from the HTTPS_PROXY or ALL_PROXY environment variables, in upper
+// or lower case, unless the host is excluded by NO_PROXY.
+func proxyFromEnvironment(host string) string {
+	if noProxy(host, getenv("NO_PROXY")) {
+		return ""
+	}
+	if proxy := getenv("HTTPS_PROXY"); proxy != "" {
+		return proxy
+	}
+	return getenv("ALL_PROXY")
+}
+
+func getenv(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+// Whether the host matches the comma separated NO_PROXY list, where a
+// name also matches all its subdomains and * matches everything.
+func noProxy(host string, list string) bool {
+	host = strings.ToLower(host)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.TrimPrefix(entry, ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dial a tcp connection to the address, through the proxy if there is one.
+func dialTCP(ctx context.Context, proxy string, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	u, err := proxyURL(proxy, address)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %v: %w", u.Host, err)
+	}
+	stop := closeOnDone(ctx, conn)
+	conn, err = proxyConnect(ctx, conn, u, address)
+	stop()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, fmt.Errorf("failed to connect through proxy %v: %w", u.Host, err)
+	}
+	return conn, nil
+}
+
+// Ask the proxy on conn to connect to the address.
+func proxyConnect(ctx context.Context, conn net.Conn, u *url.URL, address string) (net.Conn, error) {
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return conn, socks5Connect(ctx, conn, u, address)
+	case "https":
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			return conn, err
+		}
+		conn = tlsConn
+	}
+	return httpConnect(conn, u, address)
+}
+
+// Messages of the SOCKS5 replies, by their code.
+var socks5Errors = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// Connect to the address with the SOCKS5 protocol, RFC 1928, with the
+// username and password authentication of RFC 1929 if the URL has them.
+// The socks5h scheme lets the proxy resolve the host name.
+func socks5Connect(ctx context.Context, conn net.Conn, u *url.URL, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	// Offer no authentication and, with credentials, the password one.
+	greeting := []byte{5, 1, 0}
+	if u.User != nil {
+		greeting = []byte{5, 2, 0, 2}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return fmt.Errorf("not a SOCKS5 proxy")
+	}
+	switch reply[1] {
+	case 0:
+	case 2:
+		if u.User == nil {
+			return fmt.Errorf("%w: the proxy asks for a username and password", ErrProxyRefused)
+		}
+		password, _ := u.User.Password()
+		username := u.User.Username()
+		if len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("proxy username or password is too long")
+		}
+		auth := []byte{1, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("%w: wrong proxy username or password", ErrProxyRefused)
+		}
+	default:
+		return fmt.Errorf("%w: no acceptable authentication method", ErrProxyRefused)
+	}
+
+	request := []byte{5, 1, 0}
+	ip := net.ParseIP(host)
+	if ip == nil && u.Scheme == "socks5" {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+		ip = ips[0].IP
+	}
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return fmt.Errorf("host name is too long")
+		}
+		request = append(request, 3, byte(len(host)))
+		request = append(request, host...)
+	case ip.To4() != nil:
+		request = append(request, 1)
+		request = append(request, ip.To4()...)
+	default:
+		request = append(request, 4)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// The reply has the bound address, which isn't needed but must be
+	// read to get to the data.
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if code := header[1]; code != 0 {
+		message := fmt.Sprintf("error %d", code)
+		if int(code) < len(socks5Errors) {
+			message = socks5Errors[code]
+		}
+		return fmt.Errorf("%w: %v", ErrProxyRefused, message)
+	}
+	var size int
+	switch header[3] {
+	case 1:
+		size = net.IPv4len
+	case 4:
+		size = net.IPv6len
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		size = int(length[0])
+	default:
+		return fmt.Errorf("invalid SOCKS5 reply")
+	}
+	if _, err := io.ReadFull(conn, make([]byte, size+2)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Connect to the address with a HTTP CONNECT request, with basic
+// authentication if the URL has a username.
+func httpConnect(conn net.Conn, u *url.URL, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	reader := bufio.NewReader(conn)
+	// The body isn't read, after a successful CONNECT the rest of the
+	// stream is the relay.
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return conn, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("%w: %v", ErrProxyRefused, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		// The relay already sent something after the reply.
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// A conn with some of its data already read in a buffer.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
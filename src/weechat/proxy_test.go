@@ -0,0 +1,94 @@
+package weechat_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/maxking/weeclient/src/weechat"
+	"github.com/maxking/weeclient/src/weechat/relaytest"
+)
+
+// Address of the fake relay for the connection type.
+func relayAddr(s *relaytest.Server, connType weechat.ConnectionType) string {
+	if connType == weechat.WebsocketConnection {
+		return s.WebsocketAddr()
+	}
+	return s.Addr()
+}
+
+// URL of the proxy with the credentials.
+func proxyURL(p *relaytest.Proxy, user string, password string) string {
+	u, _ := url.Parse(p.URL())
+	u.User = url.UserPassword(user, password)
+	return u.String()
+}
+
+func TestDialThroughProxy(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	proxies := map[string]func(string, string) *relaytest.Proxy{
+		"socks5": relaytest.NewSOCKS5Proxy,
+		"http":   relaytest.NewHTTPProxy,
+	}
+	connTypes := map[string]weechat.ConnectionType{
+		"relay":     weechat.RelayConnection,
+		"websocket": weechat.WebsocketConnection,
+	}
+	for proxyName, newProxy := range proxies {
+		for _, user := range []string{"", "user"} {
+			p := newProxy(user, "p:@ss")
+			defer p.Close()
+			proxy := p.URL()
+			if user != "" {
+				proxy = proxyURL(p, user, "p:@ss")
+			}
+			for connName, connType := range connTypes {
+				t.Run(proxyName+"/"+connName+"/"+user, func(t *testing.T) {
+					opts := weechat.Options{
+						ConnType: connType,
+						Address:  relayAddr(s, connType),
+						Conn:     weechat.ConnOptions{Proxy: proxy},
+						Auth:     weechat.AuthOptions{Password: "secret"},
+					}
+					if connType == weechat.WebsocketConnection {
+						opts.Path = "/weechat"
+					}
+					c := dial(t, opts)
+					defer c.Close()
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					if _, err := c.Buffers(ctx); err != nil {
+						t.Errorf("Buffers() error = %v", err)
+					}
+					if targets := p.Targets(); len(targets) == 0 || targets[len(targets)-1] != opts.Address {
+						t.Errorf("Targets() = %v, want to end with %v", targets, opts.Address)
+					}
+				})
+			}
+			if user == "" {
+				continue
+			}
+			for name, proxy := range map[string]string{
+				"wrong password": proxyURL(p, user, "wrong"),
+				"no credentials": p.URL(),
+			} {
+				t.Run(proxyName+"/"+name, func(t *testing.T) {
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					_, err := weechat.Dial(ctx, weechat.Options{
+						ConnType: weechat.RelayConnection,
+						Address:  s.Addr(),
+						Conn:     weechat.ConnOptions{Proxy: proxy},
+						Auth:     weechat.AuthOptions{Password: "secret"},
+					})
+					if !errors.Is(err, weechat.ErrProxyRefused) {
+						t.Errorf("Dial() error = %v, want ErrProxyRefused", err)
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package weechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/maxking/weeclient/src/weechat/commands"
+)
+
+// State of the connection of a Reconnector.
+type ConnState int
+
+const (
+	// Connecting and authenticating with the relay.
+	ConnConnecting ConnState = iota
+	// Connected and synced with the relay.
+	ConnConnected
+	// The connection was lost, waiting before connecting again.
+	ConnDisconnected
+	// Stopped for good, either because it was closed or because of an
+	// error that retrying won't fix, like a wrong password.
+	ConnClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnConnecting:
+		return "connecting"
+	case ConnConnected:
+		return "connected"
+	case ConnDisconnected:
+		return "disconnected"
+	case ConnClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// A change of the connection state of a Reconnector.
+type ConnEvent struct {
+	State ConnState
+	// Why the connection was lost or closed, if not on purpose.
+	Err error
+	// Delay before the next attempt when disconnected.
+	Retry time.Duration
+}
+
+// Describe the event for a status line.
+func (e ConnEvent) String() string {
+	switch {
+	case e.State == ConnDisconnected:
+		return fmt.Sprintf("disconnected: %v, reconnecting in %v", e.Err, e.Retry.Round(100*time.Millisecond))
+	case e.Err != nil:
+		return fmt.Sprintf("%v: %v", e.State, e.Err)
+	}
+	return e.State.String()
+}
+
+// Exponential backoff between reconnection attempts. The delay starts at
+// Min and doubles after each failed attempt up to Max, then a random
+// fraction of it, up to Jitter, is removed so that many clients
+// disconnected at once don't all come back at the same time.
+type Backoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Jitter float64
+}
+
+// Backoff used by NewReconnector.
+var DefaultBackoff = Backoff{Min: time.Second, Max: time.Minute, Jitter: 0.5}
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Delay before the attempt, counting from 0 for the first retry.
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := b.Min
+	for i := 0; i < attempt && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+	if b.Jitter > 0 {
+		jitterMu.Lock()
+		f := jitterRand.Float64()
+		jitterMu.Unlock()
+		delay -= time.Duration(float64(delay) * b.Jitter * f)
+	}
+	return delay
+}
+
+// Reconnector keeps a Client connected to the relay. Every time it
+// connects it authenticates, sends InitialCommands() and syncs, so a
+// State updated from its events is brought up to date with whatever was
+// missed while disconnected. It does the same after an /upgrade of
+// Weechat, which changes all the pointers. The events of all the
+// connections go to the same Events() channel.
+//
+// The Options are used for every connection, so AuthOptions.TotpPrompt is
+// called again on each reconnection if the relay asks for a TOTP.
+type Reconnector struct {
+	Options Options
+	// Number of lines fetched for each buffer on every connection.
+	Lines   int
+	Backoff Backoff
+	// Interval between pings to detect a dead connection, like after
+	// the laptop was suspended, 0 to disable.
+	KeepAlive time.Duration
+	// Called by Connect and Run with every change of the connection state.
+	OnState func(ConnEvent)
+
+	mu     sync.Mutex
+	client *Client
+	events *eventQueue
+}
+
+// Create a Reconnector with the default settings. Nothing happens until
+// Connect or Run is called.
+func NewReconnector(opts Options) *Reconnector {
+	return &Reconnector{
+		Options:   opts,
+		Lines:     DefaultLines,
+		Backoff:   DefaultBackoff,
+		KeepAlive: 30 * time.Second,
+		events:    newEventQueue(),
+	}
+}
+
+// Channel with the events of all the connections, closed after the last
+// one when Run returns. It must be read until it is closed. A reader that
+// falls more than maxQueuedEvents events behind makes the Reconnector
+// drop the connection with ErrEventsOverflow and connect again, so that
+// the events it missed are fetched again.
+func (r *Reconnector) Events() <-chan *WeechatMessage {
+	return r.events.out
+}
+
+// The Client of the current connection, nil while disconnected.
+func (r *Reconnector) Client() *Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.client
+}
+
+// Send a command on the current connection.
+func (r *Reconnector) Command(cmd commands.Command) error {
+	c := r.Client()
+	if c == nil {
+		return ErrNotConnected
+	}
+	return c.Command(cmd)
+}
+
+// Connect to the relay, fetch the buffers and sync. It can be called
+// before Run to make sure that the first connection works, Run connects
+// otherwise.
+func (r *Reconnector) Connect(ctx context.Context) error {
+	r.setState(ConnEvent{State: ConnConnecting})
+	c, err := Dial(ctx, r.Options)
+	if err != nil {
+		return err
+	}
+	if err := r.initialize(c); err != nil {
+		c.Close()
+		return err
+	}
+	r.mu.Lock()
+	r.client = c
+	r.mu.Unlock()
+	r.setState(ConnEvent{State: ConnConnected})
+	return nil
+}
+
+// Forward the events and reconnect with backoff whenever the connection
+// is lost, until ctx is done or the relay rejects the password. The
+// connection is closed when it returns.
+func (r *Reconnector) Run(ctx context.Context) error {
+	defer r.events.close()
+	attempt := 0
+	for {
+		var err error
+		if r.Client() == nil {
+			err = r.Connect(ctx)
+		}
+		if err == nil {
+			attempt = 0
+			err = r.forward(ctx)
+		}
+		if ctx.Err() != nil {
+			r.setState(ConnEvent{State: ConnClosed})
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrAuthFailed) {
+			r.setState(ConnEvent{State: ConnClosed, Err: err})
+			return err
+		}
+
+		delay := r.Backoff.Delay(attempt)
+		attempt++
+		r.setState(ConnEvent{State: ConnDisconnected, Err: err, Retry: delay})
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			r.setState(ConnEvent{State: ConnClosed})
+			return ctx.Err()
+		}
+	}
+}
+
+// Forward the events of the current connection until it is lost and
+// return why.
+func (r *Reconnector) forward(ctx context.Context) error {
+	c := r.Client()
+	defer func() {
+		r.mu.Lock()
+		r.client = nil
+		r.mu.Unlock()
+	}()
+
+	var tick <-chan time.Time
+	if r.KeepAlive > 0 {
+		ticker := time.NewTicker(r.KeepAlive)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	dead := make(chan error, 1)
+	events := c.Events()
+	for {
+		select {
+		case msg, ok := <-events:
+			if !ok {
+				return c.Err()
+			}
+			if err := r.events.push(msg); err != nil {
+				c.Close()
+				return err
+			}
+			if err := r.upgrade(c, msg); err != nil {
+				c.Close()
+				return err
+			}
+		case <-tick:
+			go func() {
+				pingCtx, cancel := context.WithTimeout(ctx, r.KeepAlive)
+				defer cancel()
+				if err := c.Ping(pingCtx); err != nil && ctx.Err() == nil {
+					select {
+					case dead <- err:
+					default:
+					}
+				}
+			}()
+		case err := <-dead:
+			c.Close()
+			return fmt.Errorf("no answer to ping: %w", err)
+		case <-ctx.Done():
+			c.Close()
+			return ctx.Err()
+		}
+	}
+}
+
+// Send the initial commands and sync, on every new connection and after
+// Weechat was upgraded.
+func (r *Reconnector) initialize(c *Client) error {
+	for _, cmd := range InitialCommands(r.Lines) {
+		if err := c.Command(cmd); err != nil {
+			return err
+		}
+	}
+	_, err := c.Subscribe()
+	return err
+}
+
+// Weechat doesn't send the buffer events while it upgrades and all the
+// pointers change with it, so stop the events on _upgrade and fetch
+// everything again on _upgrade_ended, like on a new connection.
+func (r *Reconnector) upgrade(c *Client, msg *WeechatMessage) error {
+	switch msg.Msgid {
+	case "_upgrade":
+		cmd, err := commands.Desync(nil, commands.SyncBuffers, commands.SyncBuffer, commands.SyncNicklist)
+		if err != nil {
+			return err
+		}
+		return c.Command(cmd)
+	case "_upgrade_ended":
+		return r.initialize(c)
+	}
+	return nil
+}
+
+func (r *Reconnector) setState(event ConnEvent) {
+	if r.OnState != nil {
+		r.OnState(event)
+	}
+}
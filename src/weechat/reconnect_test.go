@@ -0,0 +1,212 @@
+package weechat_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxking/weeclient/src/weechat"
+	"github.com/maxking/weeclient/src/weechat/relaytest"
+)
+
+// Start a Reconnector to the fake relay, it is stopped at the end of the
+// test.
+func runReconnector(t *testing.T, s *relaytest.Server, lines int) *weechat.Reconnector {
+	t.Helper()
+	r := weechat.NewReconnector(weechat.Options{
+		ConnType: weechat.RelayConnection,
+		Address:  s.Addr(),
+		Auth:     weechat.AuthOptions{Password: s.Password},
+	})
+	r.Lines = lines
+	r.Backoff = weechat.Backoff{Min: 10 * time.Millisecond, Max: 100 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		for range r.Events() {
+		}
+		<-done
+	})
+	return r
+}
+
+// Update the state with the events until the one with the msgid.
+func waitFor(t *testing.T, events <-chan *weechat.WeechatMessage, state *weechat.State, msgid string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-events:
+			if !ok {
+				t.Fatalf("events closed while waiting for %v", msgid)
+			}
+			if err := state.Update(msg); err != nil {
+				t.Fatalf("Update(%v) error = %v", msg.Msgid, err)
+			}
+			if msg.Msgid == msgid {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %v", msgid)
+		}
+	}
+}
+
+func messages(buf *weechat.BufferState) []string {
+	var msgs []string
+	for _, line := range buf.Lines {
+		msgs = append(msgs, line.Message)
+	}
+	return msgs
+}
+
+func TestBackoff(t *testing.T) {
+	b := weechat.Backoff{Min: time.Second, Max: 10 * time.Second}
+	for attempt, want := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		if got := b.Delay(attempt); got != want*time.Second {
+			t.Errorf("Delay(%v) = %v, want %v", attempt, got, want*time.Second)
+		}
+	}
+	if got := b.Delay(1000); got != b.Max {
+		t.Errorf("Delay(1000) = %v, want %v", got, b.Max)
+	}
+
+	// The jitter removes up to that fraction of the delay.
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := b.Delay(3); got < 4*time.Second || got > 8*time.Second {
+			t.Fatalf("Delay(3) with jitter = %v, want between 4s and 8s", got)
+		}
+	}
+}
+
+func TestReconnectorDedup(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	s.AddBuffer(&relaytest.Buffer{FullName: "irc.libera.#go", Lines: []relaytest.Line{{Message: "one", Displayed: true}}})
+	s.AddBuffer(&relaytest.Buffer{FullName: "irc.libera.#rust"})
+	r := runReconnector(t, s, weechat.DefaultLines)
+	state := weechat.NewState(0)
+	waitFor(t, r.Events(), state, "hotlist")
+	s.AddLine("irc.libera.#go", relaytest.Line{Message: "two", Displayed: true})
+	waitFor(t, r.Events(), state, "_buffer_line_added")
+
+	// The lines fetched again after reconnecting aren't added twice and the
+	// buffers closed meanwhile are removed.
+	s.Disconnect()
+	for r.Client() != nil {
+		time.Sleep(time.Millisecond)
+	}
+	s.AddLine("irc.libera.#go", relaytest.Line{Message: "three", Displayed: true})
+	s.CloseBuffer("irc.libera.#rust")
+	waitFor(t, r.Events(), state, "hotlist")
+
+	buf, _ := state.BufferByName("irc.libera.#go")
+	if got := strings.Join(messages(buf), " "); got != "one two three" {
+		t.Errorf("lines = %v, want one two three", got)
+	}
+	if _, ok := state.BufferByName("irc.libera.#rust"); ok {
+		t.Errorf("BufferByName() found the closed buffer")
+	}
+}
+
+func TestReconnectorAuthFailed(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	r := weechat.NewReconnector(weechat.Options{
+		ConnType: weechat.RelayConnection,
+		Address:  s.Addr(),
+		Auth:     weechat.AuthOptions{Password: "wrong"},
+	})
+	var last weechat.ConnEvent
+	r.OnState = func(e weechat.ConnEvent) { last = e }
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A wrong password isn't retried.
+	if err := r.Run(ctx); !errors.Is(err, weechat.ErrAuthFailed) {
+		t.Errorf("Run() error = %v, want ErrAuthFailed", err)
+	}
+	if last.State != weechat.ConnClosed {
+		t.Errorf("last state = %v, want ConnClosed", last.State)
+	}
+}
+
+func TestReconnectorUpgrade(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	s.AddBuffer(&relaytest.Buffer{FullName: "irc.libera.#go", Lines: []relaytest.Line{
+		{Message: "one", Displayed: true},
+		{Message: "two", Displayed: true},
+		{Message: "three", Displayed: true},
+	}})
+	r := runReconnector(t, s, 2)
+	state := weechat.NewState(0)
+	waitFor(t, r.Events(), state, "hotlist")
+	before, _ := state.BufferByName("irc.libera.#go")
+
+	// The Reconnector desyncs on _upgrade and fetches everything again
+	// on _upgrade_ended, with its own number of lines.
+	go s.Upgrade()
+	waitFor(t, r.Events(), state, "_upgrade_ended")
+	if len(state.Buffers()) != 0 {
+		t.Errorf("Buffers() after the upgrade = %v, want none", state.Buffers())
+	}
+	waitFor(t, r.Events(), state, "hotlist")
+	after, ok := state.BufferByName("irc.libera.#go")
+	if !ok || after.Pointer == before.Pointer || after.Pointer != s.Buffer("irc.libera.#go").Pointer {
+		t.Fatalf("buffer after the upgrade = %+v, before %+v", after, before)
+	}
+	if got := messages(after); len(got) != 2 || got[0] != "two" || got[1] != "three" {
+		t.Errorf("lines after the upgrade = %v, want [two three]", got)
+	}
+
+	// Synced again for the events.
+	if err := r.Client().Ping(context.Background()); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+	s.AddLine("irc.libera.#go", relaytest.Line{Message: "four", Displayed: true})
+	waitFor(t, r.Events(), state, "_buffer_line_added")
+	after, _ = state.BufferByName("irc.libera.#go")
+	if got := messages(after); len(got) != 3 || got[2] != "four" {
+		t.Errorf("lines after the event = %v, want [two three four]", got)
+	}
+}
+
+func TestReconnectorOwnLines(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	s.AddBuffer(&relaytest.Buffer{FullName: "irc.libera.#go", Lines: []relaytest.Line{
+		{Prefix: "me", Message: "hello", Displayed: true, NotifyLevel: weechat.NotifyNone},
+	}})
+	r := runReconnector(t, s, weechat.DefaultLines)
+	state := weechat.NewState(0)
+	waitFor(t, r.Events(), state, "listlines")
+	buf, _ := state.BufferByName("irc.libera.#go")
+	if len(buf.Lines) != 1 || buf.Lines[0].NotifyLevel != weechat.NotifyNone {
+		t.Fatalf("lines = %+v, want 1 line with NotifyNone", buf.Lines)
+	}
+
+	waitFor(t, r.Events(), state, "hotlist")
+	if err := r.Client().Ping(context.Background()); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+	s.AddLine("irc.libera.#go", relaytest.Line{Prefix: "me", Message: "again", Displayed: true, NotifyLevel: weechat.NotifyNone})
+	s.AddLine("irc.libera.#go", relaytest.Line{Prefix: "bob", Message: "hi", Displayed: true, NotifyLevel: weechat.NotifyMessage})
+	waitFor(t, r.Events(), state, "_buffer_line_added")
+	waitFor(t, r.Events(), state, "_buffer_line_added")
+	buf, _ = state.BufferByName("irc.libera.#go")
+	if len(buf.Lines) != 3 {
+		t.Fatalf("lines = %v, want 3", messages(buf))
+	}
+	// Only the line of bob is unread.
+	if total := buf.Hotlist.Total(); total != 1 {
+		t.Errorf("Hotlist.Total() = %v, want 1", total)
+	}
+}
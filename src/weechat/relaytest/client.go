@@ -0,0 +1,592 @@
+package relaytest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/maxking/weeclient/src/weechat"
+)
+
+// A single client connected to the fake relay, either over tcp or over
+// a websocket.
+type client struct {
+	server *Server
+	// Only one of writer and ws is set depending on the connection type.
+	writer io.Writer
+	ws     *websocket.Conn
+	closer io.Closer
+
+	mu            sync.Mutex
+	authenticated bool
+	synced        bool
+	// Whether the client gets the _upgrade and _upgrade_ended events,
+	// which are synced separately from the buffer events.
+	upgradeSynced bool
+	// Hash algorithm and nonce negotiated in the handshake, if any.
+	hashAlgo string
+	nonce    []byte
+	// Compression negotiated in the handshake for the messages sent to
+	// the client.
+	compression string
+}
+
+func (c *client) isSynced(upgrade bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if upgrade {
+		return c.upgradeSynced
+	}
+	return c.synced
+}
+
+func (c *client) close() {
+	c.closer.Close()
+}
+
+// Encode and send a single message to the client.
+func (c *client) send(msg *weechat.WeechatMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The same message may be sent to many clients, each with its own
+	// compression.
+	compressed := *msg
+	compressed.Compression = c.compression
+	data, err := c.server.proto.Encode(&compressed)
+	if err != nil {
+		return err
+	}
+	if c.ws != nil {
+		return c.ws.WriteMessage(websocket.BinaryMessage, data)
+	}
+	_, err = c.writer.Write(data)
+	return err
+}
+
+// Read commands, one per line, and answer them until the connection is
+// closed.
+func (c *client) serve(reader *bufio.Reader) {
+	c.server.mu.Lock()
+	c.server.clients[c] = true
+	c.server.mu.Unlock()
+	defer func() {
+		c.server.mu.Lock()
+		delete(c.server.clients, c)
+		c.server.mu.Unlock()
+		c.close()
+	}()
+
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			if !c.handle(line) {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Split a command into the optional msgid, the command name and the
+// arguments.
+func parseCommand(line string) (id, name, args string) {
+	if strings.HasPrefix(line, "(") {
+		if end := strings.Index(line, ")"); end > 0 {
+			id = line[1:end]
+			line = strings.TrimLeft(line[end+1:], " ")
+		}
+	}
+	parts := strings.SplitN(line, " ", 2)
+	name = parts[0]
+	if len(parts) > 1 {
+		args = parts[1]
+	}
+	return
+}
+
+// Handle a single command, returns false if the connection should be
+// closed.
+func (c *client) handle(line string) bool {
+	id, name, args := parseCommand(line)
+
+	c.mu.Lock()
+	authenticated := c.authenticated
+	c.mu.Unlock()
+
+	if name == "handshake" && c.server.NoHandshake {
+		return true
+	}
+	// Like weechat, close the connection for any command before a
+	// successful init.
+	if name != "init" && name != "handshake" && !authenticated {
+		return false
+	}
+
+	switch name {
+	case "handshake":
+		c.send(&weechat.WeechatMessage{
+			Msgid:  id,
+			Type:   weechat.OBJ_HTB,
+			Object: c.handshake(parseOptions(args)),
+		})
+	case "init":
+		options := parseOptions(args)
+		algo, ok := c.checkPassword(options)
+		if !ok || !c.checkTotp(options["totp"]) {
+			return false
+		}
+		c.mu.Lock()
+		c.authenticated = true
+		c.mu.Unlock()
+		c.server.mu.Lock()
+		c.server.logins = append(c.server.logins, algo)
+		c.server.mu.Unlock()
+	case "hdata":
+		c.send(&weechat.WeechatMessage{
+			Msgid:  id,
+			Type:   weechat.OBJ_HDA,
+			Object: c.server.hdata(args),
+		})
+	case "nicklist":
+		c.send(&weechat.WeechatMessage{
+			Msgid:  id,
+			Type:   weechat.OBJ_HDA,
+			Object: c.server.nicklist(args),
+		})
+	case "input":
+		parts := strings.SplitN(args, " ", 2)
+		if len(parts) != 2 {
+			return true
+		}
+		in := Input{Buffer: parts[0], Text: parts[1]}
+		c.server.mu.Lock()
+		c.server.inputs = append(c.server.inputs, in)
+		onInput := c.server.OnInput
+		c.server.mu.Unlock()
+		if onInput != nil {
+			onInput(c.server, in)
+		}
+	case "sync", "desync":
+		// The buffers are ignored, the events are for all the buffers.
+		events, upgrade := syncOptions(args)
+		c.mu.Lock()
+		if events {
+			c.synced = name == "sync"
+		}
+		if upgrade {
+			c.upgradeSynced = name == "sync"
+		}
+		c.mu.Unlock()
+	case "info":
+		c.send(&weechat.WeechatMessage{
+			Msgid:  id,
+			Type:   weechat.OBJ_INF,
+			Object: c.server.info(args),
+		})
+	case "ping":
+		c.send(&weechat.WeechatMessage{
+			Msgid:  "_pong",
+			Type:   weechat.OBJ_STR,
+			Object: weechat.WeechatObject{ObjType: weechat.OBJ_STR, Value: args},
+		})
+	case "quit":
+		return false
+	}
+	return true
+}
+
+// Parse the arguments of sync and desync into whether they are for the
+// buffer events and for the upgrade events. Without options they are for
+// all the events.
+func syncOptions(args string) (events bool, upgrade bool) {
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		return true, true
+	}
+	for _, opt := range strings.Split(fields[1], ",") {
+		switch opt {
+		case "upgrade":
+			upgrade = true
+		case "buffers", "buffer", "nicklist":
+			events = true
+		}
+	}
+	return events, upgrade
+}
+
+// Parse comma separated key=value options, like the ones of init. Commas
+// in the values are escaped with a backslash.
+func parseOptions(args string) map[string]string {
+	options := make(map[string]string)
+	var option strings.Builder
+	add := func() {
+		kv := strings.SplitN(option.String(), "=", 2)
+		if len(kv) == 2 {
+			options[kv[0]] = kv[1]
+		}
+		option.Reset()
+	}
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == '\\' && i+1 < len(args) && args[i+1] == ',':
+			option.WriteByte(',')
+			i++
+		case args[i] == ',':
+			add()
+		default:
+			option.WriteByte(args[i])
+		}
+	}
+	add()
+	return options
+}
+
+// Answer the handshake by picking the strongest hash algorithm supported
+// by both and the first compression offered by the client that the relay
+// supports, like weechat does.
+func (c *client) handshake(options map[string]string) weechat.WeechatObject {
+	offered := strings.Split(options["password_hash_algo"], ":")
+	algo := ""
+	for _, supported := range c.server.HashAlgos {
+		for _, o := range offered {
+			if o == supported {
+				algo = supported
+			}
+		}
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	totp := "off"
+	if c.server.TotpSecret != "" {
+		totp = "on"
+	}
+
+	compression := weechat.CompressionOff
+	for _, o := range strings.Split(options["compression"], ":") {
+		if contains(c.server.Compressions, o) {
+			compression = o
+			break
+		}
+	}
+
+	c.mu.Lock()
+	c.hashAlgo = algo
+	c.nonce = nonce
+	c.compression = compression
+	c.mu.Unlock()
+
+	return weechat.WeechatObject{ObjType: weechat.OBJ_HTB, Value: map[weechat.WeechatObject]weechat.WeechatObject{
+		str("password_hash_algo"):       str(algo),
+		str("password_hash_iterations"): str(strconv.Itoa(c.server.Iterations)),
+		str("totp"):                     str(totp),
+		str("nonce"):                    str(hex.EncodeToString(nonce)),
+		str("compression"):              str(compression),
+	}}
+}
+
+// Check the password or password hash in the options of init. Returns
+// the algorithm used and whether it was correct.
+func (c *client) checkPassword(options map[string]string) (string, bool) {
+	c.mu.Lock()
+	algo, nonce := c.hashAlgo, c.nonce
+	c.mu.Unlock()
+
+	if password, ok := options["password"]; ok {
+		// Plain text passwords are only accepted if they were picked in
+		// the handshake, or without a handshake if they are supported.
+		if nonce != nil && algo != weechat.HashPlain {
+			return weechat.HashPlain, false
+		}
+		if nonce == nil && !contains(c.server.HashAlgos, weechat.HashPlain) {
+			return weechat.HashPlain, false
+		}
+		return weechat.HashPlain, password == c.server.Password
+	}
+
+	// algo:salt:hash or algo:salt:iterations:hash
+	parts := strings.Split(options["password_hash"], ":")
+	if nonce == nil || len(parts) < 3 || parts[0] != algo {
+		return algo, false
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil || !bytes.HasPrefix(salt, nonce) {
+		return algo, false
+	}
+	iterations := 0
+	if len(parts) == 4 {
+		if iterations, err = strconv.Atoi(parts[2]); err != nil || iterations != c.server.Iterations {
+			return algo, false
+		}
+	}
+	expected, err := weechat.HashPassword(algo, c.server.Password, salt, iterations)
+	return algo, err == nil && expected == options["password_hash"]
+}
+
+// Check the TOTP, if the relay needs one. Like weechat with a window of
+// 1, the codes of the previous and the next period are accepted too.
+func (c *client) checkTotp(code string) bool {
+	if c.server.TotpSecret == "" {
+		return true
+	}
+	now := time.Now()
+	for _, t := range []time.Time{now.Add(-30 * time.Second), now, now.Add(30 * time.Second)} {
+		if expected, err := weechat.TOTP(c.server.TotpSecret, t); err == nil && expected == code {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer a hdata command. Only the buffer list and the lines of buffers
+// are understood, every other path returns an empty hdata.
+func (s *Server) hdata(args string) weechat.WeechatObject {
+	parts := strings.SplitN(args, " ", 2)
+	path, keys := parts[0], ""
+	if len(parts) > 1 {
+		keys = parts[1]
+	}
+	elements := strings.Split(path, "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buffers []*Buffer
+	switch head := strings.TrimPrefix(elements[0], "buffer:"); {
+	case head == elements[0]:
+		return emptyHda(path)
+	case strings.HasPrefix(head, "gui_buffers(*)"):
+		buffers = s.buffers
+	case strings.HasPrefix(head, "gui_buffers"):
+		if len(s.buffers) > 0 {
+			buffers = s.buffers[:1]
+		}
+	default:
+		if buf := s.findBuffer(head); buf != nil {
+			buffers = []*Buffer{buf}
+		}
+	}
+
+	if len(elements) == 1 {
+		return buffersHda(buffers, keys)
+	}
+
+	// Only buffer/lines/line/line_data is supported, with the lines
+	// selected by last_line(-N).
+	count := -1
+	for _, element := range elements[1:] {
+		if strings.HasPrefix(element, "last_line(") {
+			n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(element, "last_line("), ")"))
+			if err == nil {
+				count = -n
+			}
+		}
+	}
+	if elements[len(elements)-1] != "data" || count < 0 {
+		return emptyHda(path)
+	}
+
+	hda := weechat.WeechatHdaValue{Hpath: "buffer/lines/line/line_data"}
+	for _, buf := range buffers {
+		// Lines are returned starting from the last one, like weechat.
+		for i := len(buf.Lines) - 1; i >= 0 && i >= len(buf.Lines)-count; i-- {
+			item, itemKeys := lineItem(buf, buf.Lines[i], keys)
+			item["__path"] = weechat.WeechatObject{ObjType: "__path", Value: []string{
+				buf.Pointer, buf.Pointer + "1", buf.Pointer + "2", linePointer(buf, i)}}
+			hda.Keys = itemKeys
+			hda.Value = append(hda.Value, item)
+		}
+	}
+	return weechat.WeechatObject{ObjType: weechat.OBJ_HDA, Value: hda}
+}
+
+// Answer an info command from Infos, unknown infos have an empty value.
+func (s *Server) info(args string) weechat.WeechatObject {
+	name := strings.SplitN(args, " ", 2)[0]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return weechat.WeechatObject{ObjType: weechat.OBJ_INF, Value: map[string]string{name: s.Infos[name]}}
+}
+
+// Answer a nicklist command for a single buffer or all the buffers.
+func (s *Server) nicklist(args string) weechat.WeechatObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buffers := s.buffers
+	if name := strings.TrimSpace(args); name != "" {
+		buffers = nil
+		if buf := s.findBuffer(name); buf != nil {
+			buffers = []*Buffer{buf}
+		}
+	}
+
+	hda := weechat.WeechatHdaValue{
+		Hpath: "buffer/nicklist_item",
+		Keys:  "group:chr,visible:chr,level:int,name:str,color:str,prefix:str,prefix_color:str",
+	}
+	for _, buf := range buffers {
+		for i, nick := range buf.Nicks {
+			hda.Value = append(hda.Value, nickItem(buf, i, nick))
+		}
+	}
+	return weechat.WeechatObject{ObjType: weechat.OBJ_HDA, Value: hda}
+}
+
+// Build the hdata for the changes to the nicklist of a buffer.
+func nicklistDiffHda(buf *Buffer, diff []weechat.WeechatNickDiff) weechat.WeechatObject {
+	hda := weechat.WeechatHdaValue{
+		Hpath: "buffer/nicklist_item",
+		Keys:  "_diff:chr,group:chr,visible:chr,level:int,name:str,color:str,prefix:str,prefix_color:str",
+	}
+	for i, d := range diff {
+		item := nickItem(buf, i, d.WeechatNick)
+		item["_diff"] = weechat.WeechatObject{ObjType: weechat.OBJ_CHR, Value: d.Diff}
+		hda.Value = append(hda.Value, item)
+	}
+	return weechat.WeechatObject{ObjType: weechat.OBJ_HDA, Value: hda}
+}
+
+func nickItem(buf *Buffer, i int, nick weechat.WeechatNick) weechat.WeechatDict {
+	return weechat.WeechatDict{
+		"__path":       {ObjType: "__path", Value: []string{buf.Pointer, fmt.Sprintf("%v%x", buf.Pointer, i+1)}},
+		"group":        chr(nick.Group),
+		"visible":      chr(nick.Visible),
+		"level":        {ObjType: weechat.OBJ_INT, Value: nick.Level},
+		"name":         str(nick.Name),
+		"color":        str(nick.Color),
+		"prefix":       str(nick.Prefix),
+		"prefix_color": str(nick.PrefixColor),
+	}
+}
+
+func emptyHda(path string) weechat.WeechatObject {
+	return weechat.WeechatObject{ObjType: weechat.OBJ_HDA, Value: weechat.WeechatHdaValue{Hpath: path}}
+}
+
+// Build the hdata for a list of buffers with only the requested keys.
+func buffersHda(buffers []*Buffer, keys string) weechat.WeechatObject {
+	hda := weechat.WeechatHdaValue{Hpath: "buffer"}
+	for _, buf := range buffers {
+		localVars := make(map[weechat.WeechatObject]weechat.WeechatObject, len(buf.LocalVars))
+		for key, value := range buf.LocalVars {
+			localVars[str(key)] = str(value)
+		}
+		item := weechat.WeechatDict{
+			"number":          {ObjType: weechat.OBJ_INT, Value: buf.Number},
+			"full_name":       str(buf.FullName),
+			"short_name":      str(buf.ShortName),
+			"type":            {ObjType: weechat.OBJ_INT, Value: buf.Type},
+			"nicklist":        {ObjType: weechat.OBJ_INT, Value: int32(len(buf.Nicks))},
+			"title":           str(buf.Title),
+			"local_variables": {ObjType: weechat.OBJ_HTB, Value: localVars},
+		}
+		item, hda.Keys = selectKeys(item,
+			"number:int,full_name:str,short_name:str,type:int,nicklist:int,title:str,local_variables:htb",
+			keys)
+		item["__path"] = weechat.WeechatObject{ObjType: "__path", Value: []string{buf.Pointer}}
+		hda.Value = append(hda.Value, item)
+	}
+	return weechat.WeechatObject{ObjType: weechat.OBJ_HDA, Value: hda}
+}
+
+// Pointer of the data of the line at index in the buffer, the same one in
+// listlines and _buffer_line_added like in weechat.
+func linePointer(buf *Buffer, index int) string {
+	return fmt.Sprintf("%v%04x", buf.Pointer, index+1)
+}
+
+// Build the hdata for the last lines of a buffer, like the ones sent with
+// _buffer_line_added.
+func linesHda(hpath string, buf *Buffer, lines []Line, keys string) weechat.WeechatObject {
+	hda := weechat.WeechatHdaValue{Hpath: hpath}
+	for i, line := range lines {
+		item, itemKeys := lineItem(buf, line, keys)
+		index := len(buf.Lines) - len(lines) + i
+		item["__path"] = weechat.WeechatObject{ObjType: "__path", Value: []string{linePointer(buf, index)}}
+		hda.Keys = itemKeys
+		hda.Value = append(hda.Value, item)
+	}
+	return weechat.WeechatObject{ObjType: weechat.OBJ_HDA, Value: hda}
+}
+
+func lineItem(buf *Buffer, line Line, keys string) (weechat.WeechatDict, string) {
+	tags := make([]weechat.WeechatObject, 0, len(line.Tags))
+	for _, tag := range line.Tags {
+		tags = append(tags, str(tag))
+	}
+	date := strconv.FormatInt(line.Date.Unix(), 10)
+	item := weechat.WeechatDict{
+		"buffer":       {ObjType: weechat.OBJ_PTR, Value: buf.Pointer},
+		"date":         {ObjType: weechat.OBJ_TIM, Value: date},
+		"date_printed": {ObjType: weechat.OBJ_TIM, Value: date},
+		"displayed":    chr(line.Displayed),
+		"notify_level": {ObjType: weechat.OBJ_CHR, Value: string([]byte{byte(line.NotifyLevel)})},
+		"highlight":    chr(line.Highlight),
+		"tags_array":   {ObjType: weechat.OBJ_ARR, Value: tags},
+		"prefix":       str(line.Prefix),
+		"message":      str(line.Message),
+	}
+	return selectKeys(item,
+		"buffer:ptr,date:tim,date_printed:tim,displayed:chr,notify_level:chr,highlight:chr,tags_array:arr,prefix:str,message:str",
+		keys)
+}
+
+// Filter the item to only include the requested keys, in the order they
+// were requested. All keys are returned if none were requested. Returns
+// the filtered item and the hdata keys for it.
+func selectKeys(item weechat.WeechatDict, all string, requested string) (weechat.WeechatDict, string) {
+	types := make(map[string]string)
+	var order []string
+	for _, pair := range strings.Split(all, ",") {
+		s := strings.Split(pair, ":")
+		types[s[0]] = s[1]
+		order = append(order, s[0])
+	}
+	if strings.Trim(requested, ", ") != "" {
+		order = nil
+		for _, name := range strings.Split(requested, ",") {
+			if _, ok := types[name]; ok {
+				order = append(order, name)
+			}
+		}
+	}
+	selected := make(weechat.WeechatDict, len(order)+1)
+	pairs := make([]string, 0, len(order))
+	for _, name := range order {
+		selected[name] = item[name]
+		pairs = append(pairs, name+":"+types[name])
+	}
+	return selected, strings.Join(pairs, ",")
+}
+
+func str(value string) weechat.WeechatObject {
+	return weechat.WeechatObject{ObjType: weechat.OBJ_STR, Value: value}
+}
+
+// Weechat sends booleans as a chr with the value 0 or 1.
+func chr(value bool) weechat.WeechatObject {
+	if value {
+		return weechat.WeechatObject{ObjType: weechat.OBJ_CHR, Value: "\x01"}
+	}
+	return weechat.WeechatObject{ObjType: weechat.OBJ_CHR, Value: "\x00"}
+}
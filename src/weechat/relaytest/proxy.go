@@ -0,0 +1,272 @@
+package relaytest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Proxy is a minimal SOCKS5 or HTTP CONNECT proxy to test the connections
+// through a proxy. It checks the username and password if they are set
+// and records the addresses it was asked to connect to.
+type Proxy struct {
+	Username string
+	Password string
+
+	socks5   bool
+	mu       sync.Mutex
+	targets  []string
+	conns    map[net.Conn]bool
+	listener net.Listener
+}
+
+// Start a SOCKS5 proxy, asking for the username and password if username
+// isn't empty. Callers must call Close() when done.
+func NewSOCKS5Proxy(username string, password string) *Proxy {
+	return newProxy(username, password, true)
+}
+
+// Start a HTTP proxy which only supports CONNECT, asking for basic
+// authentication if username isn't empty. Callers must call Close() when
+// done.
+func NewHTTPProxy(username string, password string) *Proxy {
+	return newProxy(username, password, false)
+}
+
+func newProxy(username string, password string, socks5 bool) *Proxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("relaytest: failed to listen: %v", err))
+	}
+	p := &Proxy{
+		Username: username,
+		Password: password,
+		socks5:   socks5,
+		conns:    make(map[net.Conn]bool),
+		listener: listener,
+	}
+	go p.acceptLoop()
+	return p
+}
+
+// URL of the proxy for ConnOptions.Proxy, without the credentials.
+func (p *Proxy) URL() string {
+	if p.socks5 {
+		return "socks5://" + p.listener.Addr().String()
+	}
+	return "http://" + p.listener.Addr().String()
+}
+
+// Addresses the clients asked to connect to, in order.
+func (p *Proxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+// Stop the proxy and close all the connections through it.
+func (p *Proxy) Close() {
+	p.listener.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+}
+
+func (p *Proxy) acceptLoop() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.serve(conn)
+	}
+}
+
+func (p *Proxy) serve(conn net.Conn) {
+	p.mu.Lock()
+	p.conns[conn] = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	var target net.Conn
+	var err error
+	if p.socks5 {
+		target, err = p.serveSOCKS5(reader, conn)
+	} else {
+		target, err = p.serveHTTP(reader, conn)
+	}
+	if err != nil || target == nil {
+		return
+	}
+	p.mu.Lock()
+	p.conns[target] = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, target)
+		p.mu.Unlock()
+		target.Close()
+	}()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(target, reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, target)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (p *Proxy) connect(address string) (net.Conn, error) {
+	p.mu.Lock()
+	p.targets = append(p.targets, address)
+	p.mu.Unlock()
+	return net.Dial("tcp", address)
+}
+
+// Handle the SOCKS5 greeting, authentication and CONNECT request, and
+// return the connection to the target.
+func (p *Proxy) serveSOCKS5(reader *bufio.Reader, conn net.Conn) (net.Conn, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return nil, err
+	}
+	method := byte(0)
+	if p.Username != "" {
+		method = 2
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		conn.Write([]byte{5, 0xff})
+		return nil, nil
+	}
+	conn.Write([]byte{5, method})
+
+	if method == 2 {
+		username, password, err := readSOCKS5Auth(reader)
+		if err != nil {
+			return nil, err
+		}
+		if username != p.Username || password != p.Password {
+			conn.Write([]byte{1, 1})
+			return nil, nil
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return nil, err
+	}
+	var host string
+	switch request[3] {
+	case 1, 4:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == 4 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return nil, nil
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return nil, err
+	}
+	if request[1] != 1 {
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+		return nil, nil
+	}
+
+	address := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	target, err := p.connect(address)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return nil, nil
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return target, nil
+}
+
+func readSOCKS5Auth(reader *bufio.Reader) (string, string, error) {
+	var fields [2]string
+	if _, err := reader.ReadByte(); err != nil {
+		return "", "", err
+	}
+	for i := range fields {
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", "", err
+		}
+		field := make([]byte, length)
+		if _, err := io.ReadFull(reader, field); err != nil {
+			return "", "", err
+		}
+		fields[i] = string(field)
+	}
+	return fields[0], fields[1], nil
+}
+
+// Handle the CONNECT request and return the connection to the target.
+func (p *Proxy) serveHTTP(reader *bufio.Reader, conn net.Conn) (net.Conn, error) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != http.MethodConnect {
+		fmt.Fprint(conn, "HTTP/1.1 405 Method Not Allowed\r\nContent-Length: 0\r\n\r\n")
+		return nil, nil
+	}
+	if p.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.Username + ":" + p.Password))
+		if req.Header.Get("Proxy-Authorization") != "Basic "+credentials {
+			fmt.Fprint(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+				"Proxy-Authenticate: Basic realm=\"relaytest\"\r\nContent-Length: 0\r\n\r\n")
+			return nil, nil
+		}
+	}
+	target, err := p.connect(req.Host)
+	if err != nil {
+		fmt.Fprint(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return nil, nil
+	}
+	fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return target, nil
+}
@@ -0,0 +1,522 @@
+// In-process fake Weechat relay to test clients without a live Weechat.
+package relaytest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/maxking/weeclient/src/weechat"
+)
+
+// A single buffer in the fake relay.
+type Buffer struct {
+	// Pointer of the buffer, in hex without the 0x prefix. It is
+	// assigned by the server if empty.
+	Pointer   string
+	Number    int32
+	FullName  string
+	ShortName string
+	Title     string
+	// Type of the buffer, 0 for formatted and 1 for free content.
+	Type      int32
+	LocalVars map[string]string
+	Lines     []Line
+	Nicks     []weechat.WeechatNick
+}
+
+// A single line in a buffer.
+type Line struct {
+	Date      time.Time
+	Prefix    string
+	Message   string
+	Tags      []string
+	Displayed bool
+	Highlight bool
+	// Notify level of the line, like the weechat.NotifyNone of own lines.
+	NotifyLevel int8
+}
+
+// An input command received by the relay.
+type Input struct {
+	Buffer string
+	Text   string
+}
+
+// Server is a fake weechat relay which listens on a tcp port for direct
+// relay connections and on http for websocket connections at /weechat.
+// It understands the commands weeclient sends and answers them from the
+// scripted Buffers.
+type Server struct {
+	// Password expected in the init command.
+	Password string
+
+	// Password hash algorithms the relay supports, from the weakest to
+	// the strongest. Defaults to all of them.
+	HashAlgos []string
+
+	// Compression algorithms the relay supports for the messages it
+	// sends. Defaults to zstd, zlib and off.
+	Compressions []string
+
+	// Number of iterations for the PBKDF2 hash algorithms.
+	Iterations int
+
+	// Behave like the relays older than weechat 2.9, which don't know the
+	// handshake command and ignore it.
+	NoHandshake bool
+
+	// Base32 secret for the TOTP, if set the relay asks for a TOTP in
+	// init and checks it.
+	TotpSecret string
+
+	// Values of the infos answered by the info command.
+	Infos map[string]string
+
+	// Called for every input command after it is recorded. The default
+	// appends the text as a new line to the buffer from the nick "me".
+	OnInput func(s *Server, in Input)
+
+	// Credentials of the HTTP basic authentication asked for the
+	// websocket upgrade, like nginx with auth_basic. Not checked if
+	// WebsocketUsername is empty.
+	WebsocketUsername string
+	WebsocketPassword string
+	// Origins allowed to upgrade to a websocket, any if empty.
+	WebsocketOrigins []string
+	// Subprotocols the websocket upgrade picks from, in order of
+	// preference.
+	WebsocketSubprotocols []string
+
+	mu      sync.Mutex
+	buffers []*Buffer
+	// Extra listeners started with ListenTLS, ListenUnix and
+	// ListenWebsocketTLS.
+	listeners []net.Listener
+	servers   []*httptest.Server
+	inputs    []Input
+	logins    []string
+	upgrades  []http.Header
+	clients   map[*client]bool
+	nextPtr   int
+	listener  net.Listener
+	http      *httptest.Server
+	closed    chan struct{}
+	proto     weechat.Protocol
+}
+
+// Create and start a new fake relay with a "core.weechat" buffer. Callers
+// must call Close() when done.
+func NewServer(password string) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("relaytest: failed to listen: %v", err))
+	}
+	s := &Server{
+		Password: password,
+		HashAlgos: []string{weechat.HashPlain, weechat.HashSHA256, weechat.HashSHA512,
+			weechat.HashPBKDF2SHA256, weechat.HashPBKDF2SHA512},
+		Compressions: []string{weechat.CompressionZstd, weechat.CompressionZlib,
+			weechat.CompressionOff},
+		Iterations: 1000,
+		Infos:      map[string]string{"version": "3.5", "version_number": "50659328"},
+		OnInput:    echoInput,
+		clients:    make(map[*client]bool),
+		nextPtr:    0x55d0a0001000,
+		listener:   listener,
+		closed:     make(chan struct{}),
+	}
+	s.AddBuffer(&Buffer{
+		Number:    1,
+		FullName:  "core.weechat",
+		ShortName: "weechat",
+		Title:     "WeeChat (fake relay)",
+		LocalVars: map[string]string{"plugin": "core", "name": "weechat"},
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/weechat", s.serveWebsocket)
+	s.http = httptest.NewServer(mux)
+	go s.acceptLoop(listener)
+	return s
+}
+
+// Address for the direct relay connection.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Address (host:port) for the websocket connection. The path is /weechat
+// and it doesn't use SSL.
+func (s *Server) WebsocketAddr() string {
+	return s.http.Listener.Addr().String()
+}
+
+// Headers of the websocket upgrade requests received, in order, including
+// the rejected ones.
+func (s *Server) WebsocketHeaders() []http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]http.Header(nil), s.upgrades...)
+}
+
+// Return a new, not yet connected, WeechatConn of the given type pointing
+// to this server.
+func (s *Server) Conn(connType weechat.ConnectionType) weechat.WeechatConn {
+	switch connType {
+	case weechat.WebsocketConnection:
+		return weechat.WeechatConnFactory(connType, s.WebsocketAddr(), "/weechat", false)
+	default:
+		return weechat.WeechatConnFactory(connType, s.Addr(), "", false)
+	}
+}
+
+// Stop the server and disconnect all the clients.
+func (s *Server) Close() {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return
+	default:
+	}
+	close(s.closed)
+	for c := range s.clients {
+		c.close()
+	}
+	listeners, servers := s.listeners, s.servers
+	s.mu.Unlock()
+	s.listener.Close()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	for _, server := range servers {
+		server.Close()
+	}
+	s.http.Close()
+}
+
+// Listen for direct relay connections over TLS, like the ssl.weechat
+// relay, and return the address. Set config.ClientAuth to ask for client
+// certificates.
+func (s *Server) ListenTLS(config *tls.Config) (string, error) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.mu.Unlock()
+	go s.acceptLoop(listener)
+	return listener.Addr().String(), nil
+}
+
+// Listen for direct relay connections on a UNIX socket at path, like the
+// unix.weechat relay.
+func (s *Server) ListenUnix(path string) error {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.mu.Unlock()
+	go s.acceptLoop(listener)
+	return nil
+}
+
+// Listen for websocket connections over TLS, at /weechat, and return the
+// address.
+func (s *Server) ListenWebsocketTLS(config *tls.Config) string {
+	server := httptest.NewUnstartedServer(s.http.Config.Handler)
+	server.TLS = config
+	server.StartTLS()
+	s.mu.Lock()
+	s.servers = append(s.servers, server)
+	s.mu.Unlock()
+	return server.Listener.Addr().String()
+}
+
+// Close the connections of all the clients, like when the network is
+// lost, while the server keeps accepting new ones.
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.close()
+	}
+}
+
+// Add a new buffer. If there are clients synced, they are sent a
+// _buffer_opened event.
+func (s *Server) AddBuffer(buf *Buffer) {
+	s.mu.Lock()
+	if buf.Pointer == "" {
+		buf.Pointer = strconv.FormatInt(int64(s.nextPtr), 16)
+		s.nextPtr += 0x1000
+	}
+	if buf.Number == 0 {
+		buf.Number = int32(len(s.buffers) + 1)
+	}
+	s.buffers = append(s.buffers, buf)
+	s.mu.Unlock()
+
+	s.push(&weechat.WeechatMessage{
+		Msgid:  "_buffer_opened",
+		Type:   weechat.OBJ_HDA,
+		Object: buffersHda([]*Buffer{buf}, ""),
+	})
+}
+
+// Return the buffer with the given full name or pointer, nil if there is
+// no such buffer.
+func (s *Server) Buffer(name string) *Buffer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.findBuffer(name)
+}
+
+func (s *Server) findBuffer(name string) *Buffer {
+	name = strings.TrimPrefix(name, "0x")
+	for _, buf := range s.buffers {
+		if buf.FullName == name || buf.Pointer == name {
+			return buf
+		}
+	}
+	return nil
+}
+
+// Keys sent with each buffer event, like weechat does. Events that aren't
+// listed only have the number and full name.
+var bufferEventKeys = map[string]string{
+	"_buffer_renamed":          "number,full_name,short_name,local_variables",
+	"_buffer_title_changed":    "number,full_name,title",
+	"_buffer_type_changed":     "number,full_name,type",
+	"_buffer_localvar_added":   "number,full_name,local_variables",
+	"_buffer_localvar_changed": "number,full_name,local_variables",
+	"_buffer_localvar_removed": "number,full_name,local_variables",
+}
+
+// Change the buffer with the given full name or pointer with update and
+// push the event, like _buffer_renamed or _buffer_cleared, to the synced
+// clients.
+func (s *Server) UpdateBuffer(buffer string, event string, update func(buf *Buffer)) error {
+	s.mu.Lock()
+	buf := s.findBuffer(buffer)
+	if buf == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("relaytest: no buffer %v", buffer)
+	}
+	if update != nil {
+		update(buf)
+	}
+	keys, ok := bufferEventKeys[event]
+	if !ok {
+		keys = "number,full_name"
+	}
+	obj := buffersHda([]*Buffer{buf}, keys)
+	s.mu.Unlock()
+
+	s.push(&weechat.WeechatMessage{Msgid: event, Type: weechat.OBJ_HDA, Object: obj})
+	return nil
+}
+
+// Close the buffer with the given full name or pointer and push a
+// _buffer_closing event to the synced clients.
+func (s *Server) CloseBuffer(buffer string) error {
+	s.mu.Lock()
+	buf := s.findBuffer(buffer)
+	if buf == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("relaytest: no buffer %v", buffer)
+	}
+	for i, b := range s.buffers {
+		if b == buf {
+			s.buffers = append(s.buffers[:i], s.buffers[i+1:]...)
+			break
+		}
+	}
+	obj := buffersHda([]*Buffer{buf}, "number,full_name")
+	s.mu.Unlock()
+
+	s.push(&weechat.WeechatMessage{Msgid: "_buffer_closing", Type: weechat.OBJ_HDA, Object: obj})
+	return nil
+}
+
+// Apply the changes to the nicks of the buffer with the given full name
+// or pointer and push them in a _nicklist_diff to the synced clients.
+func (s *Server) NicklistDiff(buffer string, diff ...weechat.WeechatNickDiff) error {
+	s.mu.Lock()
+	buf := s.findBuffer(buffer)
+	if buf == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("relaytest: no buffer %v", buffer)
+	}
+	changes := make([]*weechat.WeechatNickDiff, len(diff))
+	for i := range diff {
+		changes[i] = &diff[i]
+	}
+	buf.Nicks = weechat.ApplyNickDiff(buf.Nicks, changes)
+	obj := nicklistDiffHda(buf, diff)
+	s.mu.Unlock()
+
+	s.push(&weechat.WeechatMessage{Msgid: "_nicklist_diff", Type: weechat.OBJ_HDA, Object: obj})
+	return nil
+}
+
+// Simulate an /upgrade of Weechat: push _upgrade, give all the buffers new
+// pointers and push _upgrade_ended, to the clients synced for upgrades.
+func (s *Server) Upgrade() {
+	s.pushTo(&weechat.WeechatMessage{Msgid: "_upgrade", Type: weechat.OBJ_HDA, Object: emptyHda("")}, true)
+	s.mu.Lock()
+	for _, buf := range s.buffers {
+		buf.Pointer = strconv.FormatInt(int64(s.nextPtr), 16)
+		s.nextPtr += 0x1000
+	}
+	s.mu.Unlock()
+	s.pushTo(&weechat.WeechatMessage{Msgid: "_upgrade_ended", Type: weechat.OBJ_HDA, Object: emptyHda("")}, true)
+}
+
+// Add a line to the buffer with the given full name or pointer and push
+// a _buffer_line_added event to the synced clients.
+func (s *Server) AddLine(buffer string, line Line) error {
+	s.mu.Lock()
+	buf := s.findBuffer(buffer)
+	if buf == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("relaytest: no buffer %v", buffer)
+	}
+	if line.Date.IsZero() {
+		line.Date = time.Now()
+	}
+	buf.Lines = append(buf.Lines, line)
+	obj := linesHda("line_data", buf, []Line{line}, "")
+	s.mu.Unlock()
+
+	s.push(&weechat.WeechatMessage{Msgid: "_buffer_line_added", Type: weechat.OBJ_HDA, Object: obj})
+	return nil
+}
+
+// Return the password hash algorithm used by every successful init so
+// far, "plain" for plain text passwords.
+func (s *Server) Logins() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.logins...)
+}
+
+// Return all the input commands received so far.
+func (s *Server) Inputs() []Input {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Input(nil), s.inputs...)
+}
+
+// Send a message to all the clients that have sent a sync command.
+func (s *Server) Push(msg *weechat.WeechatMessage) {
+	s.push(msg)
+}
+
+func (s *Server) push(msg *weechat.WeechatMessage) {
+	s.pushTo(msg, false)
+}
+
+// Send a message to the clients synced for the upgrade events if upgrade
+// is true, otherwise to the ones synced for the buffer events.
+func (s *Server) pushTo(msg *weechat.WeechatMessage, upgrade bool) {
+	s.mu.Lock()
+	var synced []*client
+	for c := range s.clients {
+		if c.isSynced(upgrade) {
+			synced = append(synced, c)
+		}
+	}
+	s.mu.Unlock()
+	for _, c := range synced {
+		c.send(msg)
+	}
+}
+
+// Default input handler which echoes back the message into the buffer.
+func echoInput(s *Server, in Input) {
+	s.AddLine(in.Buffer, Line{Prefix: "me", Message: in.Text, Displayed: true})
+}
+
+func (s *Server) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &client{server: s, writer: conn, closer: conn}
+		go c.serve(bufio.NewReader(conn))
+	}
+}
+
+func (s *Server) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.upgrades = append(s.upgrades, r.Header.Clone())
+	s.mu.Unlock()
+	if s.WebsocketUsername != "" {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != s.WebsocketUsername || password != s.WebsocketPassword {
+			w.Header().Set("WWW-Authenticate", `Basic realm="relaytest"`)
+			http.Error(w, "401 Authorization Required", http.StatusUnauthorized)
+			return
+		}
+	}
+	upgrader := websocket.Upgrader{
+		Subprotocols: s.WebsocketSubprotocols,
+		CheckOrigin:  s.checkOrigin,
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &client{server: s, ws: ws, closer: ws}
+	c.serve(bufio.NewReader(&websocketReader{ws: ws}))
+}
+
+func (s *Server) checkOrigin(r *http.Request) bool {
+	if len(s.WebsocketOrigins) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	for _, allowed := range s.WebsocketOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Adapts the messages on a websocket to a stream of commands.
+type websocketReader struct {
+	ws  *websocket.Conn
+	buf []byte
+}
+
+func (r *websocketReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		_, msg, err := r.ws.ReadMessage()
+		if err != nil {
+			return 0, io.EOF
+		}
+		r.buf = msg
+		// Commands in a websocket message may not end in a newline.
+		if len(r.buf) > 0 && r.buf[len(r.buf)-1] != '\n' {
+			r.buf = append(r.buf, '\n')
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
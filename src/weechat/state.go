@@ -0,0 +1,379 @@
+package weechat
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Number of lines in a buffer that weren't read yet, for each notify level
+// of the lines, like the hotlist in weechat.
+type Hotlist struct {
+	Low       int
+	Message   int
+	Private   int
+	Highlight int
+}
+
+// Notify levels of a line, which are also the indices of the count in a
+// hotlist hdata.
+const (
+	NotifyNone      = -1
+	NotifyLow       = 0
+	NotifyMessage   = 1
+	NotifyPrivate   = 2
+	NotifyHighlight = 3
+)
+
+// Add count lines with the notify level to the hotlist.
+func (h *Hotlist) add(level int, count int) {
+	switch level {
+	case NotifyLow:
+		h.Low += count
+	case NotifyMessage:
+		h.Message += count
+	case NotifyPrivate:
+		h.Private += count
+	case NotifyHighlight:
+		h.Highlight += count
+	}
+}
+
+// Total number of unread lines.
+func (h Hotlist) Total() int {
+	return h.Low + h.Message + h.Private + h.Highlight
+}
+
+// A snapshot of a single buffer in the State.
+type BufferState struct {
+	// Pointer of the buffer, in hex without the 0x prefix.
+	Pointer   string
+	Number    int32
+	FullName  string
+	ShortName string
+	Title     string
+	LocalVars map[string]string
+	// Type of the buffer, 0 for formatted and 1 for free content.
+	Type   int32
+	Hidden bool
+	// Lines from the oldest to the newest. The lines are shared between
+	// snapshots and must not be modified.
+	Lines []*WeechatLine
+	Nicks []WeechatNick
+	// Whether Nicks has the whole nicklist, fetched with the nicklist
+	// command. The _nicklist_diff events are ignored until then, since
+	// applying them to an empty list gives only part of the nicks.
+	NicksLoaded bool
+	Hotlist     Hotlist
+}
+
+// Copy the buffer so that the snapshot doesn't change with the State.
+func (b *BufferState) copy() *BufferState {
+	c := *b
+	c.LocalVars = make(map[string]string, len(b.LocalVars))
+	for k, v := range b.LocalVars {
+		c.LocalVars[k] = v
+	}
+	c.Lines = append([]*WeechatLine(nil), b.Lines...)
+	c.Nicks = append([]WeechatNick(nil), b.Nicks...)
+	return &c
+}
+
+// State holds the buffers of the relay keyed by their pointer, with their
+// lines, nicklists, local variables and hotlist counts. It doesn't know
+// about any UI, so any frontend can render from it. Update() it with every
+// message from the relay, from a single goroutine, and read it from as
+// many goroutines as needed. All the readers return copies.
+type State struct {
+	// Maximum number of lines kept for each buffer, 0 for no limit.
+	MaxLines int
+
+	mu      sync.RWMutex
+	buffers map[string]*BufferState
+	// Whether the message being handled is an event, lines from events
+	// are unread while lines from listlines are history.
+	event bool
+	// Whether Weechat is upgrading, between _upgrade and _upgrade_ended.
+	upgrading bool
+}
+
+// Create a new empty State that keeps at most maxLines lines per buffer,
+// 0 for no limit.
+func NewState(maxLines int) *State {
+	return &State{MaxLines: maxLines, buffers: make(map[string]*BufferState)}
+}
+
+// Update the state with a message from the relay, either a reply to the
+// initial commands (listbuffers, listlines, nicklist and hotlist) or a
+// sync event. Messages that don't change the state are ignored.
+func (s *State) Update(msg *WeechatMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.event = strings.HasPrefix(msg.Msgid, "_")
+	return HandleMessage(msg, (*stateHandler)(s))
+}
+
+// Get a snapshot of all the buffers, sorted by their number.
+func (s *State) Buffers() []*BufferState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	buffers := make([]*BufferState, 0, len(s.buffers))
+	for _, buf := range s.buffers {
+		buffers = append(buffers, buf.copy())
+	}
+	sort.Slice(buffers, func(i, j int) bool {
+		if buffers[i].Number != buffers[j].Number {
+			return buffers[i].Number < buffers[j].Number
+		}
+		return buffers[i].FullName < buffers[j].FullName
+	})
+	return buffers
+}
+
+// Get a snapshot of the buffer with the given pointer.
+func (s *State) Buffer(pointer string) (*BufferState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	buf, ok := s.buffers[strings.TrimPrefix(pointer, "0x")]
+	if !ok {
+		return nil, false
+	}
+	return buf.copy(), true
+}
+
+// Get a snapshot of the buffer with the given full name.
+func (s *State) BufferByName(fullName string) (*BufferState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, buf := range s.buffers {
+		if buf.FullName == fullName {
+			return buf.copy(), true
+		}
+	}
+	return nil, false
+}
+
+// Reset the hotlist of a buffer, when it is read in the frontend.
+func (s *State) MarkRead(pointer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if buf, ok := s.buffers[strings.TrimPrefix(pointer, "0x")]; ok {
+		buf.Hotlist = Hotlist{}
+	}
+}
+
+// Whether Weechat is upgrading. The buffers are kept while it upgrades and
+// dropped once it is done, since their pointers change, so the state is
+// rebuilt from the replies to listbuffers and listlines sent again.
+func (s *State) Upgrading() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.upgrading
+}
+
+// Get the buffer with the pointer, creating an empty one if it isn't known
+// yet. Must be called with the lock held.
+func (s *State) buffer(pointer string) *BufferState {
+	pointer = strings.TrimPrefix(pointer, "0x")
+	buf, ok := s.buffers[pointer]
+	if !ok {
+		buf = &BufferState{Pointer: pointer, LocalVars: make(map[string]string)}
+		s.buffers[pointer] = buf
+	}
+	return buf
+}
+
+// Implements HandleWeechatMessage for the State, it is a separate type so
+// that the handler methods aren't part of the State API. The lock is held
+// by Update.
+type stateHandler State
+
+func (h *stateHandler) HandleListBuffers(buffers map[string]*WeechatBuffer) {
+	s := (*State)(h)
+	if !s.event {
+		// listbuffers has all the buffers, the ones that aren't in it
+		// were closed while we were disconnected.
+		for ptr := range s.buffers {
+			if _, ok := buffers[ptr]; !ok {
+				if _, ok := buffers["0x"+ptr]; !ok {
+					delete(s.buffers, ptr)
+				}
+			}
+		}
+	}
+	for ptr, wbuf := range buffers {
+		buf := s.buffer(ptr)
+		buf.Number = wbuf.Number
+		buf.FullName = wbuf.FullName
+		buf.ShortName = wbuf.ShortName
+		buf.Title = wbuf.Title
+		buf.Type = wbuf.Type
+		buf.LocalVars = localVars(wbuf.LocalVars)
+	}
+}
+
+// Every buffer event has the number and full name of the buffer.
+func (h *stateHandler) changed(wbuf *WeechatBuffer) *BufferState {
+	buf := (*State)(h).buffer(wbuf.Path)
+	buf.Number = wbuf.Number
+	buf.FullName = wbuf.FullName
+	return buf
+}
+
+func (h *stateHandler) HandleBufferClosing(wbuf *WeechatBuffer) {
+	delete(h.buffers, strings.TrimPrefix(wbuf.Path, "0x"))
+}
+
+func (h *stateHandler) HandleBufferRenamed(wbuf *WeechatBuffer) {
+	buf := h.changed(wbuf)
+	buf.ShortName = wbuf.ShortName
+	buf.LocalVars = localVars(wbuf.LocalVars)
+}
+
+func (h *stateHandler) HandleBufferTitleChanged(wbuf *WeechatBuffer) {
+	h.changed(wbuf).Title = wbuf.Title
+}
+
+func (h *stateHandler) HandleBufferMoved(wbuf *WeechatBuffer) {
+	h.changed(wbuf)
+}
+
+func (h *stateHandler) HandleBufferMerged(wbuf *WeechatBuffer, merged bool) {
+	h.changed(wbuf)
+}
+
+func (h *stateHandler) HandleBufferHidden(wbuf *WeechatBuffer, hidden bool) {
+	h.changed(wbuf).Hidden = hidden
+}
+
+func (h *stateHandler) HandleBufferTypeChanged(wbuf *WeechatBuffer) {
+	h.changed(wbuf).Type = wbuf.Type
+}
+
+func (h *stateHandler) HandleBufferLocalvars(wbuf *WeechatBuffer) {
+	h.changed(wbuf).LocalVars = localVars(wbuf.LocalVars)
+}
+
+func (h *stateHandler) HandleBufferCleared(wbuf *WeechatBuffer) {
+	buf := h.changed(wbuf)
+	buf.Lines = nil
+	buf.Hotlist = Hotlist{}
+}
+
+func (h *stateHandler) HandleNickList(buffer string, nicks []*WeechatNick) {
+	s := (*State)(h)
+	// A nicklist for all the buffers has the nicks of each buffer one
+	// after the other, so group them by their own buffer.
+	byBuffer := make(map[string][]WeechatNick)
+	for _, nick := range nicks {
+		ptr := nick.Buffer
+		if ptr == "" {
+			ptr = buffer
+		}
+		byBuffer[ptr] = append(byBuffer[ptr], *nick)
+	}
+	for ptr, nicks := range byBuffer {
+		buf := s.buffer(ptr)
+		buf.Nicks = nicks
+		buf.NicksLoaded = true
+	}
+}
+
+func (h *stateHandler) HandleNickListDiff(buffer string, diff []*WeechatNickDiff) {
+	buf := (*State)(h).buffer(buffer)
+	if buf.NicksLoaded {
+		buf.Nicks = ApplyNickDiff(buf.Nicks, diff)
+	}
+}
+
+func (h *stateHandler) HandleLineAdded(line *WeechatLine) {
+	s := (*State)(h)
+	buf := s.buffer(line.Buffer)
+	if s.event {
+		buf.Lines = append(buf.Lines, line)
+	} else {
+		// listlines is sent again after a reconnection, with lines that
+		// are already known.
+		lines, added := mergeLine(buf.Lines, line)
+		if !added {
+			return
+		}
+		buf.Lines = lines
+	}
+	if s.MaxLines > 0 && len(buf.Lines) > s.MaxLines {
+		buf.Lines = append([]*WeechatLine(nil), buf.Lines[len(buf.Lines)-s.MaxLines:]...)
+	}
+	if s.event && line.Displayed {
+		level := line.NotifyLevel
+		if line.Highlight {
+			level = NotifyHighlight
+		}
+		buf.Hotlist.add(level, 1)
+	}
+}
+
+func (h *stateHandler) HandleHotlist(hotlist []*WeechatHotlist) {
+	s := (*State)(h)
+	// The hotlist has only the buffers with unread lines.
+	for _, buf := range s.buffers {
+		buf.Hotlist = Hotlist{}
+	}
+	for _, entry := range hotlist {
+		if entry.Buffer == "" {
+			continue
+		}
+		buf := s.buffer(entry.Buffer)
+		for level, count := range entry.Count {
+			buf.Hotlist.add(level, int(count))
+		}
+	}
+}
+
+func (h *stateHandler) HandleUpgrade() {
+	h.upgrading = true
+}
+
+func (h *stateHandler) HandleUpgradeEnded() {
+	h.upgrading = false
+	h.buffers = make(map[string]*BufferState)
+}
+
+func (h *stateHandler) Default(msg *WeechatMessage) {}
+
+func (h *stateHandler) Debug(message string) {}
+
+// Insert a line from listlines by its date, unless the same line is
+// already there. Weechat reuses the pointers of the freed lines, so a line
+// is the same only with the same date and pointer, and only the lines
+// that aren't older are searched.
+func mergeLine(lines []*WeechatLine, line *WeechatLine) ([]*WeechatLine, bool) {
+	pointer := line.Pointer()
+	at := len(lines)
+	for i := len(lines) - 1; i >= 0 && !lines[i].Date.Before(line.Date); i-- {
+		if pointer != "" && lines[i].Pointer() == pointer && lines[i].Date.Equal(line.Date) {
+			return lines, false
+		}
+		if lines[i].Date.After(line.Date) {
+			at = i
+		}
+	}
+	lines = append(lines, nil)
+	copy(lines[at+1:], lines[at:])
+	lines[at] = line
+	return lines, true
+}
+
+// Convert the local variables of a buffer to strings.
+func localVars(vars map[WeechatObject]WeechatObject) map[string]string {
+	m := make(map[string]string, len(vars))
+	for k, v := range vars {
+		key, err := k.String()
+		if err != nil && !errors.Is(err, ErrNull) {
+			continue
+		}
+		value, _ := v.String()
+		m[key] = value
+	}
+	return m
+}
@@ -0,0 +1,74 @@
+package weechat_test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/maxking/weeclient/src/weechat"
+)
+
+type testLine struct {
+	pointer string
+	date    int64
+	message string
+}
+
+// Build a listlines reply or a _buffer_line_added event with the lines of
+// a single buffer, in the order weechat sends them.
+func linesMessage(msgid string, lines ...testLine) *weechat.WeechatMessage {
+	hda := weechat.WeechatHdaValue{Hpath: "line_data", Keys: "buffer:ptr,date:tim,displayed:chr,message:str"}
+	for _, line := range lines {
+		hda.Value = append(hda.Value, weechat.WeechatDict{
+			"__path":    {ObjType: "__path", Value: []string{line.pointer}},
+			"buffer":    {ObjType: weechat.OBJ_PTR, Value: "1a"},
+			"date":      {ObjType: weechat.OBJ_TIM, Value: strconv.FormatInt(line.date, 10)},
+			"displayed": {ObjType: weechat.OBJ_CHR, Value: "\x01"},
+			"message":   {ObjType: weechat.OBJ_STR, Value: line.message},
+		})
+	}
+	return &weechat.WeechatMessage{Msgid: msgid, Object: weechat.WeechatObject{ObjType: weechat.OBJ_HDA, Value: hda}}
+}
+
+func TestStateMergeLines(t *testing.T) {
+	state := weechat.NewState(0)
+	update := func(msg *weechat.WeechatMessage, want string) {
+		t.Helper()
+		if err := state.Update(msg); err != nil {
+			t.Fatalf("Update(%v) error = %v", msg.Msgid, err)
+		}
+		buf, _ := state.Buffer("1a")
+		if got := strings.Join(messages(buf), " "); got != want {
+			t.Fatalf("lines after %v = %v, want %v", msg.Msgid, got, want)
+		}
+	}
+
+	// listlines starts from the newest line.
+	update(linesMessage("listlines",
+		testLine{"c3", 300, "three"},
+		testLine{"b2", 200, "two"},
+		testLine{"a1", 100, "one"},
+	), "one two three")
+
+	// Weechat reuses the pointers of freed lines, the events are always
+	// added.
+	update(linesMessage("_buffer_line_added", testLine{"a1", 400, "four"}), "one two three four")
+	update(linesMessage("_buffer_line_added", testLine{"d4", 500, "five"}), "one two three four five")
+
+	// Fetched again after a reconnection, only the lines with a new date
+	// or pointer are merged, by their date.
+	update(linesMessage("listlines",
+		testLine{"f6", 500, "six"},
+		testLine{"d4", 500, "five"},
+		testLine{"a1", 400, "four"},
+		testLine{"c3", 300, "three"},
+		testLine{"b2", 200, "two"},
+		testLine{"a1", 100, "one"},
+		testLine{"e5", 50, "zero"},
+	), "zero one two three four five six")
+
+	buf, _ := state.Buffer("1a")
+	if total := buf.Hotlist.Total(); total != 2 {
+		t.Errorf("Hotlist.Total() = %v, want 2 for the events", total)
+	}
+}
@@ -0,0 +1,237 @@
+package weechat_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxking/weeclient/src/weechat"
+	"github.com/maxking/weeclient/src/weechat/relaytest"
+)
+
+// Listen for direct relay connections over TLS with a new self signed
+// certificate, return the address and the certificate in PEM.
+func listenTLS(t *testing.T, s *relaytest.Server, hosts ...string) (string, []byte) {
+	t.Helper()
+	certPEM, keyPEM, err := relaytest.SelfSignedCert(hosts...)
+	if err != nil {
+		t.Fatalf("SelfSignedCert() error = %v", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair() error = %v", err)
+	}
+	addr, err := s.ListenTLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("ListenTLS() error = %v", err)
+	}
+	return addr, certPEM
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func dialTLS(s *relaytest.Server, addr string, opts weechat.TLSOptions) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := weechat.Dial(ctx, weechat.Options{
+		ConnType: weechat.RelayConnection,
+		Address:  addr,
+		SSL:      true,
+		Conn:     weechat.ConnOptions{TLS: opts},
+		Auth:     weechat.AuthOptions{Password: s.Password},
+	})
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+func TestKnownHostsPinning(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	addr, _ := listenTLS(t, s, "127.0.0.1")
+	otherAddr, _ := listenTLS(t, s, "127.0.0.1")
+
+	var seen []string
+	known := &weechat.KnownHosts{
+		Path: filepath.Join(t.TempDir(), "weeclient", "known_hosts"),
+		OnNew: func(address string, fingerprint string) error {
+			seen = append(seen, fingerprint)
+			return nil
+		},
+	}
+	opts := weechat.TLSOptions{KnownHosts: known}
+	for i := 0; i < 2; i++ {
+		if err := dialTLS(s, addr, opts); err != nil {
+			t.Fatalf("Dial() %v error = %v", i, err)
+		}
+	}
+	if len(seen) != 1 {
+		t.Fatalf("OnNew called %v times, want 1", len(seen))
+	}
+	if stored, _ := known.Lookup(addr); stored != seen[0] {
+		t.Errorf("Lookup() = %v, want %v", stored, seen[0])
+	}
+
+	// Another certificate for a known address.
+	if err := known.Add(otherAddr, seen[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialTLS(s, otherAddr, opts); !errors.Is(err, weechat.ErrFingerprintMismatch) {
+		t.Errorf("Dial() with another certificate error = %v, want ErrFingerprintMismatch", err)
+	}
+
+	refused := errors.New("refused")
+	known.OnNew = func(string, string) error { return refused }
+	os.Remove(known.Path)
+	if err := dialTLS(s, addr, opts); !errors.Is(err, refused) {
+		t.Errorf("Dial() refused by OnNew error = %v, want %v", err, refused)
+	}
+	if stored, _ := known.Lookup(addr); stored != "" {
+		t.Errorf("Lookup() of a refused relay = %v, want none", stored)
+	}
+}
+
+func TestKnownHostsKeepsCAVerification(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	addr, certPEM := listenTLS(t, s, "relay.test")
+	ca := writeFile(t, "ca.pem", certPEM)
+	known := &weechat.KnownHosts{
+		Path: filepath.Join(t.TempDir(), "known_hosts"),
+		OnNew: func(address string, fingerprint string) error {
+			t.Errorf("OnNew(%v) called for a certificate signed by the CA", address)
+			return nil
+		},
+	}
+
+	// Signed by the CA, a relay without an entry isn't pinned.
+	opts := weechat.TLSOptions{CAFile: ca, ServerName: "relay.test", KnownHosts: known}
+	if err := dialTLS(s, addr, opts); err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	if stored, _ := known.Lookup(addr); stored != "" {
+		t.Errorf("Lookup() = %v, want nothing stored", stored)
+	}
+
+	// The host name is still checked, it isn't pinned instead.
+	err := dialTLS(s, addr, weechat.TLSOptions{CAFile: ca, ServerName: "other.test", KnownHosts: known})
+	if err == nil {
+		t.Fatal("Dial() with the wrong host name error = nil")
+	}
+	if stored, _ := known.Lookup(addr); stored != "" {
+		t.Errorf("Lookup() = %v, want nothing stored", stored)
+	}
+
+	// With an entry, the certificate must match it too.
+	if err := known.Add(addr, strings.Repeat("0", 64)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialTLS(s, addr, opts); !errors.Is(err, weechat.ErrFingerprintMismatch) {
+		t.Errorf("Dial() with another fingerprint stored error = %v, want ErrFingerprintMismatch", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	os.Remove(known.Path)
+	if err := known.Add(addr, weechat.Fingerprint(cert)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialTLS(s, addr, opts); err != nil {
+		t.Errorf("Dial() with the fingerprint stored error = %v", err)
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	certPEM, keyPEM, err := relaytest.SelfSignedCert("127.0.0.1", "relay.test")
+	if err != nil {
+		t.Fatalf("SelfSignedCert() error = %v", err)
+	}
+	cert, _ := tls.X509KeyPair(certPEM, keyPEM)
+	clientPEM, clientKeyPEM, err := relaytest.SelfSignedCert("client")
+	if err != nil {
+		t.Fatalf("SelfSignedCert() error = %v", err)
+	}
+	clients := x509.NewCertPool()
+	clients.AppendCertsFromPEM(clientPEM)
+
+	addr, err := s.ListenTLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("ListenTLS() error = %v", err)
+	}
+	mutualAddr, err := s.ListenTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clients,
+	})
+	if err != nil {
+		t.Fatalf("ListenTLS() error = %v", err)
+	}
+	ca := writeFile(t, "ca.pem", certPEM)
+	clientCert := writeFile(t, "client.pem", clientPEM)
+	clientKey := writeFile(t, "client.key", clientKeyPEM)
+
+	tests := []struct {
+		name    string
+		addr    string
+		opts    weechat.TLSOptions
+		wantErr bool
+	}{
+		{"system CAs", addr, weechat.TLSOptions{}, true},
+		{"CA file", addr, weechat.TLSOptions{CAFile: ca}, false},
+		{"insecure", addr, weechat.TLSOptions{Insecure: true}, false},
+		{"server name", addr, weechat.TLSOptions{CAFile: ca, ServerName: "relay.test"}, false},
+		{"wrong server name", addr, weechat.TLSOptions{CAFile: ca, ServerName: "other.test"}, true},
+		{"no client certificate", mutualAddr, weechat.TLSOptions{CAFile: ca}, true},
+		{"client certificate", mutualAddr, weechat.TLSOptions{CAFile: ca, CertFile: clientCert, KeyFile: clientKey}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := dialTLS(s, tt.addr, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Dial() error = %v, want an error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := (weechat.TLSOptions{CAFile: clientKey}).Config(addr); err == nil {
+		t.Errorf("Config() with a CA file without certificates error = nil")
+	}
+}
+
+func TestDialWebsocketTLS(t *testing.T) {
+	s := relaytest.NewServer("secret")
+	defer s.Close()
+	certPEM, keyPEM, err := relaytest.SelfSignedCert("127.0.0.1")
+	if err != nil {
+		t.Fatalf("SelfSignedCert() error = %v", err)
+	}
+	cert, _ := tls.X509KeyPair(certPEM, keyPEM)
+	addr := s.ListenWebsocketTLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+	c := dial(t, weechat.Options{
+		ConnType: weechat.WebsocketConnection,
+		Address:  addr,
+		SSL:      true,
+		Conn:     weechat.ConnOptions{TLS: weechat.TLSOptions{CAFile: writeFile(t, "ca.pem", certPEM)}},
+		Auth:     weechat.AuthOptions{Password: "secret"},
+	})
+	c.Close()
+}
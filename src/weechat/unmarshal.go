@@ -0,0 +1,331 @@
+package weechat
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// UnmarshalHdata fills a slice of structs, or a single struct, from the
+// items of a hdata. v must be a pointer to a slice of structs (or of
+// pointers to structs) or a pointer to a struct, in which case only the
+// first item is used.
+//
+// Fields are filled from the hdata keys named in their `weechat` tag,
+// fields without a tag are left alone and so are keys that are missing
+// in the hdata or have a NULL value. Embedded structs are filled too.
+// The special key "__path" fills a string field with the first pointer
+// of the path, usually the buffer, and a []string field with all of
+// them. For example:
+//
+//	type Buffer struct {
+//	    Pointer  string `weechat:"__path"`
+//	    FullName string `weechat:"full_name"`
+//	    Number   int32  `weechat:"number"`
+//	}
+//	var buffers []Buffer
+//	err := weechat.UnmarshalHdata(hda, &buffers)
+//
+// Values are converted to the type of the field:
+//
+//	string         str, buf, ptr, chr, lon and tim
+//	[]byte         buf and str
+//	bool           chr (0 or 1) and int
+//	int types      int, lon, chr and tim (seconds since epoch)
+//	time.Time      tim
+//	[]string       arr of str
+//	[]int types    arr of int, lon, chr and tim
+//	map[string]string                    htb with str keys and values
+//	map[WeechatObject]WeechatObject      htb
+//	[]WeechatObject                      arr
+//	WeechatObject                        any type
+//
+// Any other combination returns an *UnmarshalError.
+func UnmarshalHdata(hda WeechatHdaValue, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("UnmarshalHdata needs a non-nil pointer, got %T", v)
+	}
+	target := rv.Elem()
+
+	switch target.Kind() {
+	case reflect.Struct:
+		if len(hda.Value) == 0 {
+			return nil
+		}
+		return unmarshalItem(hda.Value[0], target)
+	case reflect.Slice:
+		elemType := target.Type().Elem()
+		isPtr := elemType.Kind() == reflect.Ptr
+		if isPtr {
+			elemType = elemType.Elem()
+		}
+		if elemType.Kind() != reflect.Struct {
+			return fmt.Errorf("UnmarshalHdata needs a slice of structs, got %T", v)
+		}
+		items := reflect.MakeSlice(target.Type(), 0, len(hda.Value))
+		for _, dict := range hda.Value {
+			item := reflect.New(elemType)
+			if err := unmarshalItem(dict, item.Elem()); err != nil {
+				return err
+			}
+			if isPtr {
+				items = reflect.Append(items, item)
+			} else {
+				items = reflect.Append(items, item.Elem())
+			}
+		}
+		target.Set(items)
+		return nil
+	default:
+		return fmt.Errorf("UnmarshalHdata needs a pointer to a slice or struct, got %T", v)
+	}
+}
+
+// UnmarshalError is returned when the value of a hdata key can't be
+// stored in the struct field with its name.
+type UnmarshalError struct {
+	Key     string
+	ObjType string
+	Field   string
+	Type    reflect.Type
+}
+
+func (e *UnmarshalError) Error() string {
+	return fmt.Sprintf("can't unmarshal hdata key %v of type %v into field %v of type %v",
+		e.Key, e.ObjType, e.Field, e.Type)
+}
+
+var (
+	objectType = reflect.TypeOf(WeechatObject{})
+	timeType   = reflect.TypeOf(time.Time{})
+)
+
+// Fill a single struct from a hdata item.
+func unmarshalItem(dict WeechatDict, target reflect.Value) error {
+	structType := target.Type()
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if err := unmarshalItem(dict, target.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+		key, ok := field.Tag.Lookup("weechat")
+		if !ok || key == "" || key == "-" || field.PkgPath != "" {
+			continue
+		}
+		obj, ok := dict[key]
+		if !ok {
+			continue
+		}
+		if key == "__path" {
+			if err := setPath(obj, field, target.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+		if obj.IsNull() {
+			continue
+		}
+		if err := setField(obj, target.Field(i)); err != nil {
+			if errors.Is(err, ErrWrongType) {
+				return &UnmarshalError{Key: key, ObjType: obj.ObjType, Field: field.Name, Type: field.Type}
+			}
+			return fmt.Errorf("failed to unmarshal hdata key %v into field %v: %w", key, field.Name, err)
+		}
+	}
+	return nil
+}
+
+// Fill a field from the pointers of the hdata path.
+func setPath(obj WeechatObject, field reflect.StructField, value reflect.Value) error {
+	pointers, _ := obj.Value.([]string)
+	switch {
+	case value.Kind() == reflect.String:
+		if len(pointers) > 0 {
+			value.SetString(pointers[0])
+		}
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.String:
+		value.Set(reflect.ValueOf(append([]string(nil), pointers...)))
+	default:
+		return &UnmarshalError{Key: "__path", ObjType: "__path", Field: field.Name, Type: field.Type}
+	}
+	return nil
+}
+
+// Store a single object in a field, converting it to the type of the
+// field. Returns ErrWrongType if it can't be converted.
+func setField(obj WeechatObject, value reflect.Value) error {
+	switch value.Type() {
+	case objectType:
+		value.Set(reflect.ValueOf(obj))
+		return nil
+	case timeType:
+		t, err := obj.Time()
+		if err != nil {
+			return err
+		}
+		value.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		var s string
+		var err error
+		switch obj.ObjType {
+		case OBJ_PTR:
+			s, err = obj.Pointer()
+		case OBJ_CHR, OBJ_LON, OBJ_TIM:
+			s, _ = obj.Value.(string)
+		default:
+			s, err = obj.String()
+		}
+		if err != nil {
+			return err
+		}
+		value.SetString(s)
+	case reflect.Bool:
+		var b bool
+		switch obj.ObjType {
+		case OBJ_INT:
+			i, err := obj.Int()
+			if err != nil {
+				return err
+			}
+			b = i != 0
+		default:
+			var err error
+			if b, err = obj.Bool(); err != nil {
+				return err
+			}
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := objectInt(obj)
+		if err != nil {
+			return err
+		}
+		if value.OverflowInt(i) {
+			return fmt.Errorf("value %v overflows %v", i, value.Type())
+		}
+		value.SetInt(i)
+	case reflect.Slice:
+		return setSlice(obj, value)
+	case reflect.Map:
+		return setMap(obj, value)
+	default:
+		return obj.wrongType(value.Type().String())
+	}
+	return nil
+}
+
+// Get the value of any of the integer like objects as an int64.
+func objectInt(obj WeechatObject) (int64, error) {
+	switch obj.ObjType {
+	case OBJ_INT:
+		i, err := obj.Int()
+		return int64(i), err
+	case OBJ_LON:
+		return obj.Long()
+	case OBJ_CHR:
+		c, err := obj.Char()
+		return int64(int8(c)), err
+	case OBJ_TIM:
+		s, _ := obj.Value.(string)
+		return strconv.ParseInt(s, 10, 64)
+	}
+	return 0, obj.wrongType(OBJ_INT, OBJ_LON, OBJ_CHR, OBJ_TIM)
+}
+
+func setSlice(obj WeechatObject, value reflect.Value) error {
+	switch elem := value.Type().Elem(); {
+	case elem.Kind() == reflect.Uint8:
+		var b []byte
+		if obj.ObjType == OBJ_STR {
+			s, err := obj.String()
+			if err != nil {
+				return err
+			}
+			b = []byte(s)
+		} else {
+			var err error
+			if b, err = obj.Bytes(); err != nil {
+				return err
+			}
+		}
+		value.SetBytes(b)
+	case elem == objectType:
+		arr, err := obj.Array()
+		if err != nil {
+			return err
+		}
+		value.Set(reflect.ValueOf(arr))
+	case elem.Kind() == reflect.String:
+		arr, err := obj.Array()
+		if err != nil {
+			return err
+		}
+		strs := make([]string, 0, len(arr))
+		for _, item := range arr {
+			s, err := item.String()
+			if err != nil && !errors.Is(err, ErrNull) {
+				return err
+			}
+			strs = append(strs, s)
+		}
+		value.Set(reflect.ValueOf(strs))
+	case elem.Kind() >= reflect.Int && elem.Kind() <= reflect.Int64:
+		arr, err := obj.Array()
+		if err != nil {
+			return err
+		}
+		ints := reflect.MakeSlice(value.Type(), len(arr), len(arr))
+		for i, item := range arr {
+			n, err := objectInt(item)
+			if err != nil {
+				return err
+			}
+			if ints.Index(i).OverflowInt(n) {
+				return fmt.Errorf("value %v overflows %v", n, elem)
+			}
+			ints.Index(i).SetInt(n)
+		}
+		value.Set(ints)
+	default:
+		return obj.wrongType(value.Type().String())
+	}
+	return nil
+}
+
+func setMap(obj WeechatObject, value reflect.Value) error {
+	htb, err := obj.Hashtable()
+	if err != nil {
+		return err
+	}
+	switch value.Type() {
+	case reflect.TypeOf(htb):
+		value.Set(reflect.ValueOf(htb))
+	case reflect.TypeOf(map[string]string{}):
+		m := make(map[string]string, len(htb))
+		for k, v := range htb {
+			key, err := k.String()
+			if err != nil && !errors.Is(err, ErrNull) {
+				return err
+			}
+			val, err := v.String()
+			if err != nil && !errors.Is(err, ErrNull) {
+				return err
+			}
+			m[key] = val
+		}
+		value.Set(reflect.ValueOf(m))
+	default:
+		return obj.wrongType(value.Type().String())
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package weechat
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// Build the bytes of a message the way the relay sends them, without
+// compression.
+func rawMessage(parts ...[]byte) []byte {
+	body := []byte{0}
+	for _, part := range parts {
+		body = append(body, part...)
+	}
+	data := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(data, uint32(4+len(body)))
+	return append(data, body...)
+}
+
+func rawStr(s string) []byte {
+	data := make([]byte, 4, 4+len(s))
+	binary.BigEndian.PutUint32(data, uint32(len(s)))
+	return append(data, s...)
+}
+
+func rawInt(i int32) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(i))
+	return data
+}
+
+func rawPtr(p string) []byte {
+	return append([]byte{byte(len(p))}, p...)
+}
+
+func rawTime(t string) []byte {
+	return append([]byte{byte(len(t))}, t...)
+}
+
+// A _buffer_line_added for an own message, which IRC tags notify_none,
+// sent by Weechat with the notify_level -1.
+func ownLineMessage(notifyLevel byte) []byte {
+	return rawMessage(
+		rawStr("_buffer_line_added"), []byte("hda"),
+		rawStr("line_data"),
+		rawStr("buffer:ptr,date:tim,displayed:chr,notify_level:chr,highlight:chr,prefix:str,message:str"),
+		rawInt(1),
+		rawPtr("55d0a0002000"),
+		rawPtr("55d0a0001000"), rawTime("1634515200"), []byte{1}, []byte{notifyLevel}, []byte{0},
+		rawStr("me"), rawStr("hello"),
+	)
+}
+
+func TestUnmarshalNegativeNotifyLevel(t *testing.T) {
+	var p Protocol
+	msg, err := p.Decode(ownLineMessage(0xff))
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	hda, err := msg.Object.Hdata()
+	if err != nil {
+		t.Fatalf("Hdata() error = %v", err)
+	}
+	if c, err := hda.Value[0]["notify_level"].Char(); err != nil || c != 0xff {
+		t.Errorf("Char() = %v, %v, want 0xff", c, err)
+	}
+
+	var lines []*WeechatLine
+	if err := UnmarshalHdata(hda, &lines); err != nil {
+		t.Fatalf("UnmarshalHdata() error = %v", err)
+	}
+	if len(lines) != 1 {
+		t.Fatalf("got %v lines, want 1", len(lines))
+	}
+	line := lines[0]
+	if line.NotifyLevel != NotifyNone {
+		t.Errorf("NotifyLevel = %v, want %v", line.NotifyLevel, NotifyNone)
+	}
+	if !line.Displayed || line.Highlight || line.Prefix != "me" || line.Message != "hello" {
+		t.Errorf("line = %+v", line)
+	}
+}
+
+func TestHandleMessageOwnLine(t *testing.T) {
+	var p Protocol
+	msg, err := p.Decode(ownLineMessage(0xff))
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	state := NewState(0)
+	if err := state.Update(msg); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	buf, ok := state.Buffer("55d0a0001000")
+	if !ok || len(buf.Lines) != 1 {
+		t.Fatalf("Buffer() = %+v, %v, want 1 line", buf, ok)
+	}
+	// Lines with the notify level none don't go in the hotlist.
+	if total := buf.Hotlist.Total(); total != 0 {
+		t.Errorf("Hotlist.Total() = %v, want 0", total)
+	}
+}
+
+func TestUnmarshalCharOverflow(t *testing.T) {
+	var p Protocol
+	msg, err := p.Decode(ownLineMessage(0x80))
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	hda, _ := msg.Object.Hdata()
+	var lines []struct {
+		NotifyLevel int8 `weechat:"notify_level"`
+	}
+	if err := UnmarshalHdata(hda, &lines); err != nil {
+		t.Fatalf("UnmarshalHdata() error = %v", err)
+	}
+	if lines[0].NotifyLevel != -128 {
+		t.Errorf("NotifyLevel = %v, want -128", lines[0].NotifyLevel)
+	}
+}